@@ -7,6 +7,7 @@ cd "$(dirname $0)"
 
 # https://stackoverflow.com/questions/3174883/how-to-remove-last-directory-from-a-path-with-sed
 export LOGDIR="${PWD%/*}/bin/log"
+export DATADIR="${PWD%/*}/bin/data"
 
 export PATH=$PATH:/usr/local/go/bin
 
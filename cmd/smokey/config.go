@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/manager"
+	"github.com/flavio-fernandes/smokey/internal/webhook"
+	"os"
+)
+
+// FileConfig is what can be set in the json file given with -config. Every
+// section is optional.
+type FileConfig struct {
+	Webhooks []webhook.Hook
+	// Colors maps names to colors, e.g. "sleepy-amber": "hsb(35, 100, 40)"
+	Colors map[string]string
+	// Circadian is the curve used by circadian mode, e.g.
+	// [{"Time": "12:00", "Kelvin": 6500, "Dim": 100}, ...]
+	Circadian []manager.CircadianPoint
+	// Profiles describe other diffuser models, to be picked with -profile
+	Profiles []manager.DeviceProfile
+}
+
+func loadFileConfig(configFile string) (*FileConfig, error) {
+	var config FileConfig
+	if configFile == "" {
+		return &config, nil
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("bad config file %s: %v", configFile, err)
+	}
+	if err = webhook.Validate(config.Webhooks); err != nil {
+		return nil, fmt.Errorf("bad config file %s: %v", configFile, err)
+	}
+	if err = manager.ValidateCircadian(config.Circadian); err != nil {
+		return nil, fmt.Errorf("bad config file %s: %v", configFile, err)
+	}
+	if err = manager.ValidateProfiles(config.Profiles); err != nil {
+		return nil, fmt.Errorf("bad config file %s: %v", configFile, err)
+	}
+	return &config, nil
+}
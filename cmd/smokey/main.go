@@ -1,26 +1,52 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"github.com/antigloss/go/logger"
+	"github.com/flavio-fernandes/smokey/internal/audit"
+	"github.com/flavio-fernandes/smokey/internal/ctl"
+	"github.com/flavio-fernandes/smokey/internal/history"
+	"github.com/flavio-fernandes/smokey/internal/http_agent"
+	"github.com/flavio-fernandes/smokey/internal/logging"
 	"github.com/flavio-fernandes/smokey/internal/manager"
 	"github.com/flavio-fernandes/smokey/internal/mqtt_agent"
 	"github.com/flavio-fernandes/smokey/internal/web"
+	"github.com/flavio-fernandes/smokey/internal/webhook"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 )
 
+var logger = logging.New("main")
+
 const (
-	DefaultLogDir     = "/tmp/smokey_log"
-	DefaultListenPort = 8080
+	DefaultLogDir          = "/tmp/smokey_log"
+	DefaultDataDir         = "/tmp/smokey_data"
+	DefaultHistoryDays     = 90
+	DefaultAuditDays       = 90
+	DefaultListenPort      = 8080
+	DefaultShutdownPolicy  = "keep"
+	DefaultOverridePolicy  = "enforce"
+	DefaultShutdownTimeout = 10 * time.Second
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(ctl.Main(os.Args[2:]))
+	}
+
 	defaultLogDir := os.Getenv("LOGDIR")
 	if defaultLogDir == "" {
 		defaultLogDir = DefaultLogDir
 	}
+	defaultDataDir := os.Getenv("DATADIR")
+	if defaultDataDir == "" {
+		defaultDataDir = DefaultDataDir
+	}
 	MqttConfig := mqtt_agent.Config{
 		ClientId:    mqtt_agent.DefMqttClientId,
 		BrokerUrl:   mqtt_agent.DefBrokerURL,
@@ -33,53 +59,172 @@ func main() {
 		defaultListenPort = int(i)
 	}
 
-	debugParamPtr := flag.Bool("debug", false, "enable trace level logs")
+	debugParamPtr := flag.Bool("debug", false, "enable trace level logs for all subsystems")
+	logLevelParamPtr := flag.String("loglevel", "info", "log level, and per subsystem (manager, mqtt, http, web, webhook, history, audit), e.g. info,mqtt=trace,web=warn")
+	logFormatParamPtr := flag.String("logformat", logging.FormatLogfmt, "log format: logfmt or json")
+	logStdoutParamPtr := flag.Bool("logstdout", false, "log to stdout (e.g. for journald) instead of files in logdir")
+	configFilePtr := flag.String("config", os.Getenv("SMOKEYCONFIG"), "json config file; or use env SMOKEYCONFIG")
 	logDirParamPtr := flag.String("logdir", defaultLogDir, "or use env LOGDIR to override")
+	dataDirParamPtr := flag.String("datadir", defaultDataDir, "where state is persisted; or use env DATADIR to override")
+	historyDaysPtr := flag.Int("historydays", DefaultHistoryDays, "days of usage history to keep")
+	auditDaysPtr := flag.Int("auditdays", DefaultAuditDays, "days of audit log of commands to keep")
 	clientIdParamPtr := flag.String("client", MqttConfig.ClientId, "mqtt client id")
 	brokerUrlParamPtr := flag.String("broker", MqttConfig.BrokerUrl, "mqtt broker url")
 	userParamPtr := flag.String("user", MqttConfig.User, "mqtt username")
 	passParamPtr := flag.String("pass", MqttConfig.Pass, "mqtt password")
 	topicPrefixParamPtr := flag.String("topic", MqttConfig.TopicPrefix, "mqtt topic device prefix")
+	deviceUrlParamPtr := flag.String("deviceurl", "", "talk to tasmota over http at this url (e.g. http://192.168.10.50) instead of mqtt")
+	deviceUserParamPtr := flag.String("deviceuser", http_agent.DefDeviceUser, "tasmota web username, with -deviceurl")
+	devicePassParamPtr := flag.String("devicepass", "", "tasmota web password, with -deviceurl")
+	devicePollParamPtr := flag.Duration("devicepoll", http_agent.DefPollInterval, "how often to poll the device status, with -deviceurl")
+	deviceErrorParamPtr := flag.String("deviceerror", "", "tasmota command that answers with the device error value (e.g. Var1), with -deviceurl")
 	listenPortPtr := flag.Int("listenport", defaultListenPort, "or use LISTENPORT to override")
 	advertiseStatePtr := flag.Bool("advertise", false, "mqtt publish state of diffuser/light")
+	tlsCertPtr := flag.String("tlscert", "", "certificate file for serving https (reloaded when changed)")
+	tlsKeyPtr := flag.String("tlskey", "", "private key file for serving https")
+	tlsClientCAPtr := flag.String("tlsclientca", "", "ca file to verify client certificates; only verified clients can send commands")
+	tokenFilePtr := flag.String("tokenfile", "", "file with '<name> <token>' lines; when set, commands need one of these bearer tokens")
+	shutdownPolicyPtr := flag.String("shutdown", DefaultShutdownPolicy, "what to do with device on exit: keep, diffuser-off or all-off")
+	profilePtr := flag.String("profile", manager.DefaultProfile, "device profile: asakuki or one from the config file")
+	overridePolicyPtr := flag.String("override", DefaultOverridePolicy, "what to do when the device is turned on or off by hand: enforce or adopt")
 	flag.Parse()
 
+	shutdownPolicy, err := manager.ShutdownPolicyVal(*shutdownPolicyPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad shutdown policy: %v\n", err)
+		os.Exit(1)
+	}
+	overridePolicy, err := manager.OverridePolicyVal(*overridePolicyPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad override policy: %v\n", err)
+		os.Exit(1)
+	}
+	fileConfig, err := loadFileConfig(*configFilePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	profile, err := manager.FindProfile(*profilePtr, fileConfig.Profiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
 	MqttConfig.ClientId = *clientIdParamPtr
 	MqttConfig.BrokerUrl = *brokerUrlParamPtr
 	MqttConfig.User = *userParamPtr
 	MqttConfig.Pass = *passParamPtr
 	MqttConfig.TopicPrefix = *topicPrefixParamPtr
 
-	// https://github.com/antigloss/go/blob/f29271b1356642b597925cfa554f4997bddb5cee/logger/logger.go#L83
-	loggerConfig := logger.Config{
-		LogDir:          *logDirParamPtr,
-		LogFileMaxSize:  4,
-		LogFileMaxNum:   20,
-		LogFileNumToDel: 5,
-		LogLevel:        logger.LogLevelInfo,
-		LogDest:         logger.LogDestFile,
+	logLevels, err := logging.ParseLevels(*logLevelParamPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
 	}
 	if *debugParamPtr {
-		loggerConfig.LogLevel = logger.LogLevelTrace
-		loggerConfig.LogDest = logger.LogDestBoth
+		for subsystem := range logLevels {
+			logLevels[subsystem] = logging.LevelTrace
+		}
 	}
-	err := logger.Init(&loggerConfig)
+	device := MqttConfig.TopicPrefix
+	if *deviceUrlParamPtr != "" {
+		device = *deviceUrlParamPtr
+	}
+	loggerConfig := logging.Config{
+		Format:      *logFormatParamPtr,
+		Levels:      logLevels,
+		Stdout:      *logStdoutParamPtr,
+		Dir:         *logDirParamPtr,
+		MaxFileSize: logging.DefMaxFileSize,
+		MaxFiles:    logging.DefMaxFiles,
+		Fields:      map[string]string{"device": device},
+	}
+	err = logging.Init(&loggerConfig)
 	if err != nil {
 		fmt.Fprintf(os.Stderr,
 			fmt.Sprint("logger init failed ", *logDirParamPtr, " ", err, "\n"))
 		os.Exit(1)
 	}
 
-	mqttSubMsgChannel := make(chan mqtt_agent.Msg, 1024)
-	mqttPubMsgChannel := mqtt_agent.Start(&MqttConfig, mqttSubMsgChannel)
-	mgr := manager.Start(mqttPubMsgChannel, mqttSubMsgChannel, *advertiseStatePtr)
-	web.Start(mgr, fmt.Sprintf("%d", *listenPortPtr))
+	historyStore, err := history.Open(filepath.Join(*dataDirParamPtr, "history.jsonl"),
+		time.Duration(*historyDaysPtr)*24*time.Hour)
+	if err != nil {
+		logger.Errorf("Unable to open history: %v", err)
+		os.Exit(1)
+	}
+	defer historyStore.Close()
+	auditStore, err := audit.Open(filepath.Join(*dataDirParamPtr, "audit.jsonl"),
+		time.Duration(*auditDaysPtr)*24*time.Hour)
+	if err != nil {
+		logger.Errorf("Unable to open audit: %v", err)
+		os.Exit(1)
+	}
+	defer auditStore.Close()
+	palette, err := manager.LoadPalette(fileConfig.Colors, filepath.Join(*dataDirParamPtr, "colors.json"))
+	if err != nil {
+		logger.Errorf("Unable to load colors: %v", err)
+		os.Exit(1)
+	}
 
-	for {
-		select {
-		case <-mgr.StopChan:
-			logger.Infof("stopping main application")
-			return
-		}
+	var transport manager.Transport = &mqtt_agent.Transport{Config: MqttConfig}
+	if *deviceUrlParamPtr != "" {
+		transport = http_agent.New(&http_agent.Config{
+			DeviceUrl:    *deviceUrlParamPtr,
+			User:         *deviceUserParamPtr,
+			Pass:         *devicePassParamPtr,
+			PollInterval: *devicePollParamPtr,
+			ErrorCmnd:    *deviceErrorParamPtr,
+			MistCmnd:     profile.MistCmnd,
+		}, nil)
+	}
+	mgrConfig := manager.Config{
+		AdvertiseState: *advertiseStatePtr,
+		History:        historyStore,
+		Audit:          auditStore,
+		WaterFile:      filepath.Join(*dataDirParamPtr, "water.json"),
+		ScheduledFile:  filepath.Join(*dataDirParamPtr, "scheduled.json"),
+		Override:       overridePolicy,
+		Circadian:      fileConfig.Circadian,
+		Profile:        profile,
+		Palette:        palette,
+	}
+	var webhooks *webhook.Dispatcher
+	if len(fileConfig.Webhooks) > 0 {
+		webhooks = webhook.Start(fileConfig.Webhooks)
+		mgrConfig.OnEvent = webhooks.Notify
+	}
+	mgr := manager.Start(transport, &mgrConfig)
+	webConfig := web.Config{
+		ListenPort:      fmt.Sprintf("%d", *listenPortPtr),
+		TLSCertFile:     *tlsCertPtr,
+		TLSKeyFile:      *tlsKeyPtr,
+		TLSClientCAFile: *tlsClientCAPtr,
+		TokenFile:       *tokenFilePtr,
+		History:         historyStore,
+		Audit:           auditStore,
+	}
+	web.Start(mgr, &webConfig)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-mgr.StopChan:
+		logger.Infof("stopping main application")
+		return
+	case sig := <-signals:
+		logger.Infof("got signal %v: stopping main application", sig)
+	}
+
+	// Order matters: stop taking new requests, let manager apply the shutdown
+	// policy and then flush what it published before disconnecting. Webhooks
+	// go last, to send the events of the shutdown.
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	web.Stop(ctx)
+	mgr.Stop(shutdownPolicy)
+	transport.Stop(DefaultShutdownTimeout)
+	if webhooks != nil {
+		webhooks.Stop(DefaultShutdownTimeout)
 	}
+	logger.Infof("stopped main application")
 }
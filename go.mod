@@ -2,10 +2,7 @@ module github.com/flavio-fernandes/smokey
 
 go 1.17
 
-require (
-	github.com/antigloss/go v0.0.0-20201201072909-f29271b13566
-	github.com/eclipse/paho.mqtt.golang v1.3.5
-)
+require github.com/eclipse/paho.mqtt.golang v1.3.5
 
 require (
 	github.com/gorilla/websocket v1.4.2 // indirect
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"encoding/json"
+	"github.com/flavio-fernandes/smokey/internal/jsonl"
+	"github.com/flavio-fernandes/smokey/internal/logging"
+	"time"
+)
+
+var logger = logging.New("audit")
+
+// Sources of the changes to the device. SourceMqtt is a command someone
+// else published to the device, SourceDevice a change made on the device
+// itself (e.g. its button). The steps of light modes (effects, circadian,
+// transitions) are not recorded: they follow the command that started them.
+const (
+	SourceApi       = "api"
+	SourceTimer     = "timer"
+	SourceSchedule  = "schedule"
+	SourceReconcile = "reconcile"
+	SourceMqtt      = "mqtt"
+	SourceDevice    = "device"
+	SourceShutdown  = "shutdown"
+)
+
+// Entry is a change to the device and who asked for it. Client, Token and
+// Request are only set for the api.
+type Entry struct {
+	Ts      time.Time
+	Source  string
+	Client  string `json:",omitempty"`
+	Token   string `json:",omitempty"`
+	Request string `json:",omitempty"`
+	Action  string
+	Details string `json:",omitempty"`
+}
+
+func (e Entry) Time() time.Time {
+	return e.Ts
+}
+
+func decodeEntry(data []byte) (jsonl.Record, error) {
+	var e Entry
+	err := json.Unmarshal(data, &e)
+	return e, err
+}
+
+// Store keeps the audit trail in a json lines file, so it survives
+// restarts. Entries older than retention are dropped.
+type Store struct {
+	entries *jsonl.Store
+}
+
+func Open(path string, retention time.Duration) (*Store, error) {
+	entries, err := jsonl.Open(path, retention, decodeEntry, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{entries: entries}, nil
+}
+
+// Record adds an entry, timestamped now.
+func (s *Store) Record(e Entry) {
+	e.Ts = time.Now()
+	s.entries.Append(e)
+}
+
+// Query returns the entries between from and to (inclusive). An empty
+// source matches all of them.
+func (s *Store) Query(from, to time.Time, source string) []Entry {
+	result := []Entry{}
+	for _, r := range s.entries.Query(from, to, nil) {
+		if e := r.(Entry); source == "" || e.Source == source {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (s *Store) Close() error {
+	return s.entries.Close()
+}
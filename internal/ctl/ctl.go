@@ -0,0 +1,740 @@
+package ctl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/audit"
+	"github.com/flavio-fernandes/smokey/internal/manager"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config tells ctl how to reach smokey. Values come from the config file,
+// then env variables and finally command line flags, each overriding the
+// previous one.
+type Config struct {
+	Url    string `json:"url"`
+	Token  string `json:"token"`
+	CACert string `json:"caCert"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+}
+
+const (
+	DefUrl        = "http://127.0.0.1:8080"
+	DefConfigFile = ".config/smokey/ctl.json" // relative to home dir
+	DefWatchEvery = 5 * time.Second
+	httpTimeout   = 15 * time.Second
+)
+
+const usage = `usage: smokey ctl [global flags] <command> [flags] [args]
+
+commands:
+  light on [--mode MODE] [--color COLOR] [--for DURATION]
+           [--fade-out DURATION] [--in DURATION | --at TIME]
+           [--colors C1,C2,...] [--interval SECS] [--crossfade]
+           [--min-dim PERCENT] [--max-dim PERCENT] [--bpm BREATHS]
+  light off
+  light color [--transition DURATION] COLOR
+  light dim [--transition DURATION] PERCENT
+  light timer +DURATION|-DURATION|DEADLINE
+  diffuser on [--for DURATION] [--in DURATION | --at TIME]
+  diffuser off
+  diffuser timer +DURATION|-DURATION|DEADLINE
+  diffuser mist [--mode continuous|intermittent] [--level high|low]
+  state [--watch] [--every DURATION]
+  query
+  water
+  faults [--since DURATION]
+  audit [--since DURATION] [--source SOURCE]
+  scheduled [cancel ID]
+
+DURATION uses go syntax (e.g. 30m, 1h30m); 0 disables auto off.
+TIME and DEADLINE are RFC3339 or HH:MM for today. timer moves the auto off
+by DURATION, or to DEADLINE.
+
+global flags:
+`
+
+var errUsage = errors.New("bad usage")
+
+type client struct {
+	conf       Config
+	jsonOutput bool
+	httpClient *http.Client
+	out        io.Writer
+}
+
+// Main runs the ctl sub command and returns the process exit code.
+func Main(args []string) int {
+	conf, err := loadConfig(configFile(args))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "smokey ctl: %v\n", err)
+		return 1
+	}
+
+	fs := flag.NewFlagSet("smokey ctl", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.String("config", "", "config file (or use env SMOKEY_CTL_CONFIG; default ~/"+DefConfigFile+")")
+	fs.StringVar(&conf.Url, "url", conf.Url, "smokey url (or use env SMOKEY_URL)")
+	fs.StringVar(&conf.Token, "token", conf.Token, "api token (or use env SMOKEY_TOKEN)")
+	fs.StringVar(&conf.CACert, "cacert", conf.CACert, "ca file to verify smokey's https certificate")
+	fs.StringVar(&conf.Cert, "cert", conf.Cert, "client certificate file for mutual tls")
+	fs.StringVar(&conf.Key, "key", conf.Key, "client key file for mutual tls")
+	jsonOutput := fs.Bool("json", false, "print json instead of human readable output")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	c := client{conf: conf, jsonOutput: *jsonOutput, out: os.Stdout}
+	if c.httpClient, err = newHttpClient(&conf); err != nil {
+		fmt.Fprintf(os.Stderr, "smokey ctl: %v\n", err)
+		return 1
+	}
+	if err = c.run(fs.Args()); err != nil {
+		if errors.Is(err, errUsage) {
+			fs.Usage()
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "smokey ctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// configFile finds the config file before the flags are parsed, so values
+// in it can be used as flag defaults.
+func configFile(args []string) string {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg || arg == "--" {
+			break
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv("SMOKEY_CTL_CONFIG")
+}
+
+func loadConfig(configFile string) (Config, error) {
+	conf := Config{Url: DefUrl}
+	mustExist := configFile != ""
+	if !mustExist {
+		if home, err := os.UserHomeDir(); err == nil {
+			configFile = filepath.Join(home, DefConfigFile)
+		}
+	}
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err == nil {
+			if err = json.Unmarshal(data, &conf); err != nil {
+				return conf, fmt.Errorf("bad config file %s: %v", configFile, err)
+			}
+		} else if mustExist || !errors.Is(err, os.ErrNotExist) {
+			return conf, err
+		}
+	}
+	if v := os.Getenv("SMOKEY_URL"); v != "" {
+		conf.Url = v
+	}
+	if v := os.Getenv("SMOKEY_TOKEN"); v != "" {
+		conf.Token = v
+	}
+	return conf, nil
+}
+
+func newHttpClient(conf *Config) (*http.Client, error) {
+	httpClient := http.Client{Timeout: httpTimeout}
+	if conf.CACert == "" && conf.Cert == "" {
+		return &httpClient, nil
+	}
+	tlsConfig := tls.Config{MinVersion: tls.VersionTLS12}
+	if conf.CACert != "" {
+		caPem, err := os.ReadFile(conf.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.CACert)
+		}
+	}
+	if conf.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	httpClient.Transport = &http.Transport{TLSClientConfig: &tlsConfig}
+	return &httpClient, nil
+}
+
+func (c *client) run(args []string) error {
+	switch args[0] {
+	case "light":
+		return c.light(args[1:])
+	case "diffuser", "smoke":
+		return c.diffuser(args[1:])
+	case "state", "status":
+		return c.state(args[1:])
+	case "query":
+		return c.query()
+	case "water":
+		return c.water()
+	case "faults":
+		return c.faults(args[1:])
+	case "audit":
+		return c.audit(args[1:])
+	case "scheduled":
+		return c.scheduled(args[1:])
+	}
+	return errUsage
+}
+
+func (c *client) light(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	fs := flag.NewFlagSet("light "+args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "on":
+		mode := fs.String("mode", "", "crazy, solid, night-mode, sunshine, cycle, candle, breathe or circadian")
+		color := fs.String("color", "", "color name or hex value")
+		autoOff := fs.Duration("for", -1, "turn off after this long")
+		fadeOut := fs.Duration("fade-out", 0, "dim down during this long before turning off")
+		in := fs.Duration("in", 0, "turn on after this long, instead of now")
+		at := fs.String("at", "", "turn on at this time (RFC3339 or HH:MM), instead of now")
+		colors := fs.String("colors", "", "colors to go through in cycle mode")
+		interval := fs.Int("interval", 0, "seconds on each color in cycle mode")
+		crossfade := fs.Bool("crossfade", false, "fade between colors in cycle mode")
+		minDim := fs.Int("min-dim", 0, "lowest dim in breathe mode")
+		maxDim := fs.Int("max-dim", 0, "highest dim in breathe mode")
+		bpm := fs.Float64("bpm", 0, "breaths per minute in breathe mode")
+		if err := fs.Parse(args[1:]); err != nil {
+			return errUsage
+		}
+		params := url.Values{}
+		if *mode != "" {
+			params.Set("mode", *mode)
+		}
+		if *color != "" {
+			params.Set("color", *color)
+		}
+		if *fadeOut > 0 {
+			params.Set("fadeOutSecs", fmt.Sprintf("%d", int(fadeOut.Seconds())))
+		}
+		if *colors != "" {
+			params.Set("colors", *colors)
+		}
+		if *interval > 0 {
+			params.Set("intervalSecs", fmt.Sprintf("%d", *interval))
+		}
+		if *crossfade {
+			params.Set("crossfade", "true")
+		}
+		if *minDim > 0 {
+			params.Set("minDim", fmt.Sprintf("%d", *minDim))
+		}
+		if *maxDim > 0 {
+			params.Set("maxDim", fmt.Sprintf("%d", *maxDim))
+		}
+		if *bpm > 0 {
+			params.Set("bpm", strconv.FormatFloat(*bpm, 'f', -1, 64))
+		}
+		if *autoOff >= 0 {
+			params.Set("autoOffSecs", fmt.Sprintf("%d", int(autoOff.Seconds())))
+		}
+		if err := setStart(params, *in, *at); err != nil {
+			return err
+		}
+		return c.onCommand("/lighton", params)
+	case "off":
+		return c.command("/lightoff", nil)
+	case "color", "dim":
+		transition := fs.Duration("transition", 0, "take this long to get there")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+			return errUsage
+		}
+		params := url.Values{}
+		if *transition > 0 {
+			params.Set("transition", fmt.Sprintf("%d", int(transition.Seconds())))
+		}
+		if args[0] == "color" {
+			params.Set("color", fs.Arg(0))
+			return c.command("/lightcolor", params)
+		}
+		params.Set("dim", strings.TrimSuffix(fs.Arg(0), "%"))
+		return c.command("/lightdim", params)
+	case "timer":
+		return c.timer(manager.TimerLight, args[1:])
+	}
+	return errUsage
+}
+
+func (c *client) diffuser(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	fs := flag.NewFlagSet("diffuser "+args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "on":
+		autoOff := fs.Duration("for", -1, "turn off after this long")
+		in := fs.Duration("in", 0, "turn on after this long, instead of now")
+		at := fs.String("at", "", "turn on at this time (RFC3339 or HH:MM), instead of now")
+		if err := fs.Parse(args[1:]); err != nil {
+			return errUsage
+		}
+		params := url.Values{}
+		if *autoOff >= 0 {
+			params.Set("autoOffSecs", fmt.Sprintf("%d", int(autoOff.Seconds())))
+		}
+		if err := setStart(params, *in, *at); err != nil {
+			return err
+		}
+		return c.onCommand("/diffuseron", params)
+	case "off":
+		return c.command("/diffuseroff", nil)
+	case "timer":
+		return c.timer(manager.TimerDiffuser, args[1:])
+	case "mist":
+		mode := fs.String("mode", "", "mist mode: continuous or intermittent")
+		level := fs.String("level", "", "mist level: high or low")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 {
+			return errUsage
+		}
+		params := url.Values{}
+		if *mode != "" {
+			params.Set("mode", *mode)
+		}
+		if *level != "" {
+			params.Set("level", *level)
+		}
+		return c.command("/mist", params)
+	}
+	return errUsage
+}
+
+// parseTime takes RFC3339 or HH:MM for today, and gives RFC3339
+func parseTime(s string) (string, error) {
+	if t, err := time.ParseInLocation("15:04", s, time.Local); err == nil {
+		now := time.Now()
+		t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+		return t.Format(time.RFC3339), nil
+	}
+	if _, err := time.Parse(time.RFC3339, s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// setStart adds when an on command should happen, if not right away
+func setStart(params url.Values, in time.Duration, at string) error {
+	if in > 0 && at != "" {
+		return errUsage
+	}
+	if in > 0 {
+		params.Set("delaySecs", fmt.Sprintf("%d", int(in.Seconds())))
+	} else if at != "" {
+		t, err := parseTime(at)
+		if err != nil {
+			return errUsage
+		}
+		params.Set("at", t)
+	}
+	return nil
+}
+
+// onCommand is like command, but also shows the id of scheduled commands
+func (c *client) onCommand(path string, params url.Values) error {
+	body, err := c.do(http.MethodPost, path, params)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return c.printOk()
+	}
+	if c.jsonOutput {
+		fmt.Fprintln(c.out, strings.TrimSpace(string(body)))
+		return nil
+	}
+	var action manager.ScheduledAction
+	if err = json.Unmarshal(body, &action); err != nil {
+		return fmt.Errorf("unexpected answer from smokey: %v", err)
+	}
+	fmt.Fprintf(c.out, "scheduled %s on at %s, id %s\n", action.Component,
+		action.At.Local().Format(time.RFC3339), action.Id)
+	return nil
+}
+
+func (c *client) scheduled(args []string) error {
+	if len(args) == 2 && args[0] == "cancel" {
+		_, err := c.do(http.MethodDelete, "/scheduled?id="+url.QueryEscape(args[1]), nil)
+		if err != nil {
+			return err
+		}
+		return c.printOk()
+	} else if len(args) != 0 {
+		return errUsage
+	}
+	body, err := c.do(http.MethodGet, "/scheduled", nil)
+	if err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		fmt.Fprintln(c.out, strings.TrimSpace(string(body)))
+		return nil
+	}
+	var actions []manager.ScheduledAction
+	if err = json.Unmarshal(body, &actions); err != nil {
+		return fmt.Errorf("unexpected answer from smokey: %v", err)
+	}
+	for _, a := range actions {
+		fmt.Fprintf(c.out, "%s  %s  %s on", a.Id, a.At.Local().Format(time.RFC3339), a.Component)
+		if a.Mode != "" {
+			fmt.Fprintf(c.out, ", mode %s", a.Mode)
+		}
+		if a.Color != "" {
+			fmt.Fprintf(c.out, ", color %s", a.Color)
+		}
+		fmt.Fprintln(c.out)
+	}
+	return nil
+}
+
+// timer takes +DURATION or -DURATION to extend or shorten the auto off, or
+// a deadline, as RFC3339 or HH:MM for today.
+func (c *client) timer(component string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	params := url.Values{"component": {component}}
+	arg := args[0]
+	if strings.HasPrefix(arg, "+") || strings.HasPrefix(arg, "-") {
+		d, err := time.ParseDuration(strings.TrimPrefix(arg, "+"))
+		if err != nil {
+			return errUsage
+		}
+		params.Set("addSecs", fmt.Sprintf("%d", int(d.Seconds())))
+	} else if deadline, err := parseTime(arg); err == nil {
+		params.Set("deadline", deadline)
+	} else {
+		return errUsage
+	}
+	body, err := c.do(http.MethodPost, "/timer", params)
+	if err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		fmt.Fprintln(c.out, strings.TrimSpace(string(body)))
+		return nil
+	}
+	var timer manager.Timer
+	if err = json.Unmarshal(body, &timer); err != nil {
+		return fmt.Errorf("unexpected timer from smokey: %v", err)
+	}
+	fmt.Fprintf(c.out, "%s turns off at %s, in %v\n", component, timer.Deadline,
+		time.Duration(timer.RemainingSecs)*time.Second)
+	return nil
+}
+
+func (c *client) state(args []string) error {
+	fs := flag.NewFlagSet("state", flag.ContinueOnError)
+	watch := fs.Bool("watch", false, "keep printing state as it changes")
+	every := fs.Duration("every", DefWatchEvery, "how often to poll when watching")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if !*watch {
+		body, err := c.do(http.MethodGet, "/state", nil)
+		if err != nil {
+			return err
+		}
+		return c.printState(body)
+	}
+
+	var lastSummary string
+	for {
+		body, err := c.do(http.MethodGet, "/state", nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "smokey ctl: %v\n", err)
+		} else if c.jsonOutput {
+			if err = c.printState(body); err != nil {
+				return err
+			}
+		} else if summary, err := summarize(body); err != nil {
+			return err
+		} else if summary != lastSummary {
+			fmt.Fprintf(c.out, "--- %s\n%s", time.Now().Format(time.RFC1123), summary)
+			lastSummary = summary
+		}
+		time.Sleep(*every)
+	}
+}
+
+func (c *client) query() error {
+	body, err := c.do(http.MethodPost, "/query", nil)
+	if err != nil {
+		return err
+	}
+	return c.printState(body)
+}
+
+func (c *client) water() error {
+	body, err := c.do(http.MethodGet, "/water?format=json", nil)
+	if err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		fmt.Fprintln(c.out, strings.TrimSpace(string(body)))
+		return nil
+	}
+	var water struct {
+		Level string
+		manager.WaterEstimate
+	}
+	if err = json.Unmarshal(body, &water); err != nil {
+		return fmt.Errorf("unexpected water state from smokey: %v", err)
+	}
+	fmt.Fprintf(c.out, "water: %s%s\n", water.Level, waterLeft(&water.WaterEstimate))
+	return nil
+}
+
+// faults shows the faults the device reports and when faults came and went
+func (c *client) faults(args []string) error {
+	fs := flag.NewFlagSet("faults", flag.ContinueOnError)
+	since := fs.Duration("since", 7*24*time.Hour, "show fault history for this long back")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	from := time.Now().Add(-*since).Format(time.RFC3339)
+	body, err := c.do(http.MethodGet, "/faults?from="+url.QueryEscape(from), nil)
+	if err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		fmt.Fprintln(c.out, strings.TrimSpace(string(body)))
+		return nil
+	}
+	var faults struct {
+		manager.DeviceFaults
+		Events []struct {
+			Ts    time.Time
+			Event string
+			Value string
+		}
+	}
+	if err = json.Unmarshal(body, &faults); err != nil {
+		return fmt.Errorf("unexpected faults from smokey: %v", err)
+	}
+	if len(faults.Active) == 0 && faults.UnknownBits == 0 {
+		fmt.Fprintln(c.out, "faults: none")
+	}
+	for _, f := range faults.Active {
+		fmt.Fprintf(c.out, "fault: %s (bit %d) since %s\n", f.Name, f.Bit, f.Since)
+	}
+	if faults.UnknownBits != 0 {
+		fmt.Fprintf(c.out, "fault: unknown bits %#x\n", faults.UnknownBits)
+	}
+	for _, e := range faults.Events {
+		fmt.Fprintf(c.out, "%s  %-7s  %s\n", e.Ts.Local().Format(time.RFC3339), e.Event, e.Value)
+	}
+	return nil
+}
+
+// audit shows the commands that changed the device and where they came from
+func (c *client) audit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	since := fs.Duration("since", 24*time.Hour, "show commands for this long back")
+	source := fs.String("source", "", "only show commands from this source (e.g. api, timer, reconcile)")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	query := url.Values{}
+	query.Set("from", time.Now().Add(-*since).Format(time.RFC3339))
+	if *source != "" {
+		query.Set("source", *source)
+	}
+	body, err := c.do(http.MethodGet, "/audit?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		fmt.Fprintln(c.out, strings.TrimSpace(string(body)))
+		return nil
+	}
+	var response struct {
+		Entries []audit.Entry
+	}
+	if err = json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("unexpected audit from smokey: %v", err)
+	}
+	for _, e := range response.Entries {
+		who := e.Source
+		if e.Client != "" {
+			who += " " + e.Client
+		}
+		if e.Token != "" {
+			who += " (" + e.Token + ")"
+		}
+		line := fmt.Sprintf("%s  %-28s  %s", e.Ts.Local().Format(time.RFC3339), who, e.Action)
+		if e.Details != "" {
+			line += "  " + e.Details
+		}
+		fmt.Fprintln(c.out, line)
+	}
+	return nil
+}
+
+func waterLeft(w *manager.WaterEstimate) string {
+	if w.RemainingSecs < 0 {
+		return ""
+	}
+	return fmt.Sprintf(", %d%% full, about %v of mist left",
+		w.PercentFull, time.Duration(w.RemainingSecs)*time.Second)
+}
+
+func (c *client) command(path string, params url.Values) error {
+	if _, err := c.do(http.MethodPost, path, params); err != nil {
+		return err
+	}
+	return c.printOk()
+}
+
+func (c *client) printOk() error {
+	if c.jsonOutput {
+		return json.NewEncoder(c.out).Encode(map[string]bool{"ok": true})
+	}
+	fmt.Fprintln(c.out, "ok")
+	return nil
+}
+
+func (c *client) do(method, path string, params url.Values) ([]byte, error) {
+	var body io.Reader
+	if params != nil {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.conf.Url, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.conf.Token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status,
+			strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
+
+func (c *client) printState(body []byte) error {
+	if c.jsonOutput {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, body); err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, compact.String())
+		return nil
+	}
+	summary, err := summarize(body)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(c.out, summary)
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func remaining(on bool, autoOffSecs, onSecs int) string {
+	if !on {
+		return ""
+	}
+	if autoOffSecs <= 0 {
+		return ", no auto off"
+	}
+	left := autoOffSecs - onSecs
+	if left < 0 {
+		left = 0
+	}
+	return fmt.Sprintf(", off in %v", time.Duration(left)*time.Second)
+}
+
+func summarize(body []byte) (string, error) {
+	var state manager.State
+	if err := json.Unmarshal(body, &state); err != nil {
+		return "", fmt.Errorf("unexpected state from smokey: %v", err)
+	}
+	w, o := &state.WantedState, &state.OperStateParsed
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "light:    %s (wanted %s)", onOff(o.LightOn), onOff(w.LightOn))
+	if w.LightOn {
+		fmt.Fprintf(&b, ", mode %s, color #%06x, dim %d%%", w.LightModeName, o.LightColor, o.LightDim)
+	}
+	fmt.Fprintf(&b, "%s\n", remaining(w.LightOn && o.LightOn, w.LightAutoOffSecs, o.LightOnSecs))
+	fmt.Fprintf(&b, "diffuser: %s (wanted %s)%s\n", onOff(o.DiffuserOn), onOff(w.DiffuserOn),
+		remaining(w.DiffuserOn && o.DiffuserOn, w.DiffuserAutoOffSecs, o.DiffuserOnSecs))
+	if o.MistMode != "" || w.MistMode != "" {
+		mist := "unknown"
+		if o.MistMode != "" {
+			mist = o.MistMode + " " + o.MistLevel
+		}
+		fmt.Fprintf(&b, "mist:     %s", mist)
+		if w.MistMode != "" {
+			fmt.Fprintf(&b, " (wanted %s %s)", w.MistMode, w.MistLevel)
+		}
+		fmt.Fprintln(&b)
+	}
+	water := "high"
+	if o.LowWater {
+		water = "low"
+	}
+	fmt.Fprintf(&b, "water:    %s%s\n", water, waterLeft(&state.Water))
+	lastReceive := o.LastReceiveTs
+	if lastReceive == "" {
+		lastReceive = "never"
+	}
+	fmt.Fprintf(&b, "device:   last report %s, uptime %s\n", lastReceive, strings.TrimSpace(o.Uptime))
+	return b.String(), nil
+}
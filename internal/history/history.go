@@ -0,0 +1,94 @@
+package history
+
+import (
+	"encoding/json"
+	"github.com/flavio-fernandes/smokey/internal/jsonl"
+	"github.com/flavio-fernandes/smokey/internal/logging"
+	"time"
+)
+
+var logger = logging.New("history")
+
+// Event is a single thing that happened to the device, like the diffuser
+// turning on or the water running low.
+type Event struct {
+	Ts        time.Time
+	Component string
+	Event     string
+	Value     string `json:",omitempty"`
+}
+
+func (e Event) Time() time.Time {
+	return e.Ts
+}
+
+func decodeEvent(data []byte) (jsonl.Record, error) {
+	var e Event
+	err := json.Unmarshal(data, &e)
+	return e, err
+}
+
+// Store keeps events in a json lines file, so they survive restarts. Events
+// older than retention are dropped.
+type Store struct {
+	events *jsonl.Store
+}
+
+func Open(path string, retention time.Duration) (*Store, error) {
+	events, err := jsonl.Open(path, retention, decodeEvent, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{events: events}, nil
+}
+
+// Record adds an event, timestamped now.
+func (s *Store) Record(component, event, value string) {
+	s.events.Append(Event{Ts: time.Now(), Component: component, Event: event, Value: value})
+}
+
+// Query returns the events between from and to (inclusive). An empty
+// component matches all of them.
+func (s *Store) Query(from, to time.Time, component string) []Event {
+	result := []Event{}
+	for _, r := range s.events.Query(from, to, nil) {
+		if e := r.(Event); component == "" || e.Component == component {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// OnSecs adds up how long the component was on between from and to, using
+// its on and off events.
+func (s *Store) OnSecs(from, to time.Time, component string) int {
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+	var total time.Duration
+	var onSince time.Time
+	on := false
+	for _, e := range s.Query(time.Time{}, to, component) {
+		if e.Component != component || (e.Event != "on" && e.Event != "off") {
+			continue
+		}
+		ts := e.Ts
+		if ts.Before(from) {
+			ts = from
+		}
+		if e.Event == "on" && !on {
+			on, onSince = true, ts
+		} else if e.Event == "off" && on {
+			on = false
+			total += ts.Sub(onSince)
+		}
+	}
+	if on && to.After(onSince) {
+		total += to.Sub(onSince)
+	}
+	return int(total.Seconds())
+}
+
+func (s *Store) Close() error {
+	return s.events.Close()
+}
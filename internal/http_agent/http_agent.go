@@ -0,0 +1,239 @@
+package http_agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/logging"
+	"github.com/flavio-fernandes/smokey/internal/mqtt_agent"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var logger = logging.New("http")
+
+// Config is for talking to Tasmota through its /cm?cmnd= web api, when
+// there is no mqtt broker. DeviceUrl is like "http://192.168.10.50". User
+// and Pass are the Tasmota web admin credentials, only sent when Pass is
+// set.
+//
+// Over http the device does not push its reports: the agent asks for its
+// status every PollInterval. ErrorCmnd is the command that answers with the
+// device error value, e.g. "Var1" when a Tasmota rule keeps it there. When
+// empty, low water is not reported. MistCmnd is the command of the device
+// profile that sets the mist, which also answers with its value.
+type Config struct {
+	DeviceUrl    string
+	User         string
+	Pass         string
+	PollInterval time.Duration
+	ErrorCmnd    string
+	MistCmnd     string
+}
+
+const (
+	DefDeviceUser   = "admin"
+	DefPollInterval = 30 * time.Second
+	httpTimeout     = 10 * time.Second
+	queueSize       = 512
+)
+
+// Agent is the manager.Transport that talks to the device over http. The
+// messages it takes and gives use the same topics as the mqtt agent, so the
+// manager does not know the difference.
+type Agent struct {
+	config       Config
+	httpClient   *http.Client
+	sub          chan<- mqtt_agent.Msg
+	stopQueue    chan struct{}
+	stoppedQueue chan struct{}
+}
+
+// New makes an agent for the device at config.DeviceUrl. When httpClient is
+// nil, a client with a short timeout is used.
+func New(config *Config, httpClient *http.Client) *Agent {
+	a := Agent{
+		config:       *config,
+		httpClient:   httpClient,
+		stopQueue:    make(chan struct{}),
+		stoppedQueue: make(chan struct{}),
+	}
+	if a.config.PollInterval <= 0 {
+		a.config.PollInterval = DefPollInterval
+	}
+	a.config.DeviceUrl = strings.TrimSuffix(a.config.DeviceUrl, "/")
+	if a.httpClient == nil {
+		a.httpClient = &http.Client{Timeout: httpTimeout}
+	}
+	return &a
+}
+
+// cmnd turns an mqtt topic like "smokey/cmnd/Power1" and its payload into
+// the Tasmota command "Power1 ON". Topics that are not device commands,
+// like the advertised state, give "".
+func cmnd(msg mqtt_agent.Msg) string {
+	i := strings.LastIndex(msg.Topic, "cmnd/")
+	if i < 0 {
+		return ""
+	}
+	command := msg.Topic[i+len("cmnd/"):]
+	if msg.Payload != "" {
+		command += " " + msg.Payload
+	}
+	return command
+}
+
+// redact replaces the url in err, which has the credentials in its query,
+// with shown. The errors end up in the logs.
+func redact(err error, shown string) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = shown
+	}
+	return err
+}
+
+// Send runs a command on the device and hands what it answers to sub, as
+// the mqtt report the device would have published.
+func (a *Agent) Send(command string) error {
+	query := url.Values{}
+	query.Set("cmnd", command)
+	shown := a.config.DeviceUrl + "/cm?" + query.Encode()
+	if a.config.Pass != "" {
+		query.Set("user", a.config.User)
+		query.Set("password", a.config.Pass)
+	}
+	req, err := http.NewRequest(http.MethodGet, a.config.DeviceUrl+"/cm?"+query.Encode(), nil)
+	if err != nil {
+		return redact(err, shown)
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return redact(err, shown)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, mqtt_agent.FirstN(string(body), 40))
+	}
+	logger.With("command", command).Tracef("httpAgent got %s", mqtt_agent.FirstN(string(body), 40))
+	return a.report(command, body)
+}
+
+// report translates the json answer of a command into the mqtt messages
+// the manager parses.
+func (a *Agent) report(command string, body []byte) error {
+	var result map[string]json.RawMessage
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("bad answer %q: %v", mqtt_agent.FirstN(string(body), 40), err)
+	}
+	if warning, found := result["WARNING"]; found {
+		return fmt.Errorf("device says %s", warning)
+	}
+	if _, found := result["StatusSTS"]; found {
+		a.sub <- mqtt_agent.Msg{Topic: mqtt_agent.TopicSubStatus11(), Payload: string(body)}
+	}
+	for key, topic := range map[string]string{
+		"POWER1": mqtt_agent.TopicSubPower1(),
+		"POWER2": mqtt_agent.TopicSubPower2(),
+	} {
+		var power string
+		if json.Unmarshal(result[key], &power) == nil {
+			a.sub <- mqtt_agent.Msg{Topic: topic, Payload: power}
+		}
+	}
+	for key, value := range result {
+		if a.config.MistCmnd != "" && strings.EqualFold(key, a.config.MistCmnd) {
+			a.sub <- mqtt_agent.Msg{Topic: mqtt_agent.TopicSubFanMode(), Payload: string(value)}
+		}
+	}
+	if a.config.ErrorCmnd != "" && strings.EqualFold(command, a.config.ErrorCmnd) {
+		for _, value := range result {
+			var errorValue string
+			if json.Unmarshal(value, &errorValue) != nil {
+				errorValue = string(value)
+			}
+			a.sub <- mqtt_agent.Msg{Topic: mqtt_agent.TopicSubError(), Payload: errorValue}
+		}
+	}
+	return nil
+}
+
+func (a *Agent) publish(msg mqtt_agent.Msg) {
+	command := cmnd(msg)
+	if command == "" {
+		logger.With("topic", msg.Topic).Tracef("httpAgent ignoring %q", msg.Payload)
+		return
+	}
+	if err := a.Send(command); err != nil {
+		logger.With("command", command).Errorf("httpAgent failed sending to %s: %v", a.config.DeviceUrl, err)
+		return
+	}
+	// the error value is not in any answer: ask for it with the status
+	if strings.HasSuffix(msg.Topic, mqtt_agent.DefTopicPubCheckStatus) {
+		a.poll(a.config.ErrorCmnd)
+	}
+}
+
+func (a *Agent) poll(command string) {
+	if command == "" {
+		return
+	}
+	if err := a.Send(command); err != nil {
+		logger.With("command", command).Warnf("httpAgent unable to poll %s: %v", a.config.DeviceUrl, err)
+	}
+}
+
+func (a *Agent) worker(pub <-chan mqtt_agent.Msg) {
+	defer func() { close(a.stoppedQueue) }()
+	pollTick := time.NewTicker(a.config.PollInterval)
+	defer pollTick.Stop()
+	// the manager asks for the status, water and mist when told so
+	a.sub <- mqtt_agent.Msg{Topic: mqtt_agent.TopicConnected}
+	for {
+		select {
+		case msg := <-pub:
+			a.publish(msg)
+		case <-pollTick.C:
+			a.poll("Status 11")
+			a.poll(a.config.ErrorCmnd)
+			a.poll(a.config.MistCmnd)
+		case <-a.stopQueue:
+			logger.Infof("httpAgent sending %d queued messages", len(pub))
+			for {
+				select {
+				case msg := <-pub:
+					a.publish(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Start polls the device and sends it what the manager publishes.
+func (a *Agent) Start(sub chan<- mqtt_agent.Msg) chan<- mqtt_agent.Msg {
+	pub := make(chan mqtt_agent.Msg, queueSize)
+	a.sub = sub
+	logger.Info("talking to device over http", a.config.DeviceUrl)
+	go a.worker(pub)
+	return pub
+}
+
+// Stop sends whatever is still queued. It gives up waiting after the
+// provided timeout.
+func (a *Agent) Stop(timeout time.Duration) {
+	close(a.stopQueue)
+	select {
+	case <-a.stoppedQueue:
+	case <-time.After(timeout):
+		logger.Warnf("http agent did not stop within %v", timeout)
+	}
+}
@@ -0,0 +1,198 @@
+package http_agent
+
+import (
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/mqtt_agent"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDevice is a stand-in for the Tasmota web api. reply gives the status
+// and body for a command; every command received is kept in cmnds.
+type fakeDevice struct {
+	sync.Mutex
+	cmnds []string
+	reply func(cmnd string) (int, string)
+}
+
+func (d *fakeDevice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/cm" {
+		http.NotFound(w, r)
+		return
+	}
+	cmnd := r.URL.Query().Get("cmnd")
+	d.Lock()
+	d.cmnds = append(d.cmnds, cmnd)
+	d.Unlock()
+	status, body := d.reply(cmnd)
+	w.WriteHeader(status)
+	fmt.Fprint(w, body)
+}
+
+func (d *fakeDevice) received() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string{}, d.cmnds...)
+}
+
+func newTestAgent(t *testing.T, config Config, reply func(string) (int, string)) (*Agent, *fakeDevice, chan mqtt_agent.Msg) {
+	device := &fakeDevice{reply: reply}
+	srv := httptest.NewServer(device)
+	t.Cleanup(srv.Close)
+	config.DeviceUrl = srv.URL
+	a := New(&config, srv.Client())
+	sub := make(chan mqtt_agent.Msg, 64)
+	a.sub = sub
+	return a, device, sub
+}
+
+func okReply(cmnd string) (int, string) {
+	return http.StatusOK, `{"Result":"Done"}`
+}
+
+// expectMsg waits for a message on topic, skipping others
+func expectMsg(t *testing.T, sub <-chan mqtt_agent.Msg, topic string) mqtt_agent.Msg {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case msg := <-sub:
+			if msg.Topic == topic {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no message on %s", topic)
+		}
+	}
+}
+
+func expectNoMsg(t *testing.T, sub <-chan mqtt_agent.Msg) {
+	t.Helper()
+	select {
+	case msg := <-sub:
+		t.Fatalf("unexpected message %+v", msg)
+	default:
+	}
+}
+
+func topicPayload(topic, payload string) [2]string {
+	return [2]string{topic, payload}
+}
+
+func (d *fakeDevice) got(cmnd string) bool {
+	for _, c := range d.received() {
+		if c == cmnd {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCommandsReachDevice(t *testing.T) {
+	a, device, _ := newTestAgent(t, Config{PollInterval: time.Hour}, okReply)
+	pub := a.Start(make(chan mqtt_agent.Msg, 64))
+	for _, pubMsg := range [][2]string{
+		topicPayload(mqtt_agent.MsgPubSetDiffuser(true)),
+		topicPayload(mqtt_agent.MsgPubSetLight(true)),
+		topicPayload(mqtt_agent.MsgPubSetLightDim(40)),
+		topicPayload(mqtt_agent.MsgPubSetLightColor(0xff8000)),
+	} {
+		pub <- mqtt_agent.Msg{Topic: pubMsg[0], Payload: pubMsg[1]}
+	}
+	a.Stop(5 * time.Second)
+
+	for _, want := range []string{"Power1 ON", "Power2 ON", "Dimmer0 40", "Color1 #ff8000"} {
+		if !device.got(want) {
+			t.Errorf("device did not get %q; got %q", want, device.received())
+		}
+	}
+}
+
+func TestStatusReport(t *testing.T) {
+	status := `{"StatusSTS":{"POWER1":"ON","POWER2":"OFF","Dimmer":40,"Color":"FF8000"}}`
+	a, _, sub := newTestAgent(t, Config{}, func(cmnd string) (int, string) {
+		return http.StatusOK, status
+	})
+	if err := a.Send("Status 11"); err != nil {
+		t.Fatal(err)
+	}
+	msg := expectMsg(t, sub, mqtt_agent.TopicSubStatus11())
+	if msg.Payload != status {
+		t.Errorf("got status %q, want %q", msg.Payload, status)
+	}
+}
+
+func TestErrorReport(t *testing.T) {
+	a, _, sub := newTestAgent(t, Config{ErrorCmnd: "Var1"}, func(cmnd string) (int, string) {
+		if cmnd == "Var1" {
+			return http.StatusOK, `{"Var1":"0x01"}`
+		}
+		return http.StatusInternalServerError, "oops"
+	})
+	if err := a.Send("Var1"); err != nil {
+		t.Fatal(err)
+	}
+	msg := expectMsg(t, sub, mqtt_agent.TopicSubError())
+	if msg.Payload != "0x01" {
+		t.Errorf("got error value %q, want 0x01", msg.Payload)
+	}
+
+	// a failed request is not something the device reported
+	if err := a.Send("Status 11"); err == nil {
+		t.Error("expected an error for a 500 reply")
+	}
+	expectNoMsg(t, sub)
+}
+
+func TestWarningReply(t *testing.T) {
+	a, device, sub := newTestAgent(t, Config{PollInterval: time.Hour}, func(cmnd string) (int, string) {
+		if cmnd == "Bogus" {
+			return http.StatusOK, `{"WARNING":"Need user=<username>&password=<password>"}`
+		}
+		return http.StatusOK, `{"POWER1":"ON"}`
+	})
+	if err := a.Send("Bogus"); err == nil {
+		t.Error("expected an error for a WARNING reply")
+	}
+	expectNoMsg(t, sub)
+
+	// the agent keeps going after it
+	pub := a.Start(sub)
+	pub <- mqtt_agent.Msg{Topic: "cmnd/Bogus", Payload: ""}
+	pub <- mqtt_agent.Msg{Topic: "cmnd/Power1", Payload: "ON"}
+	a.Stop(5 * time.Second)
+	if !device.got("Power1 ON") {
+		t.Errorf("command after the warning did not reach the device; got %q", device.received())
+	}
+}
+
+func TestErrorsHideCredentials(t *testing.T) {
+	device := &fakeDevice{reply: okReply}
+	srv := httptest.NewServer(device)
+	a := New(&Config{DeviceUrl: srv.URL, User: "admin", Pass: "sekret"}, srv.Client())
+	a.sub = make(chan mqtt_agent.Msg, 64)
+	if err := a.Send("Power1 ON"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Close()
+	err := a.Send("Power1 ON")
+	if err == nil {
+		t.Fatal("expected an error with the device gone")
+	}
+	if strings.Contains(err.Error(), "sekret") || strings.Contains(err.Error(), "password") {
+		t.Errorf("error shows the credentials: %v", err)
+	}
+	if !strings.Contains(err.Error(), srv.URL) || !strings.Contains(err.Error(), "Power1") {
+		t.Errorf("error does not tell the device and command: %v", err)
+	}
+
+	a.config.DeviceUrl = srv.URL + "%zz"
+	if err = a.Send("Power1 ON"); err == nil || strings.Contains(err.Error(), "sekret") {
+		t.Errorf("expected an error without the credentials for a bad url, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package jsonl
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/flavio-fernandes/smokey/internal/logging"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	pruneInterval = 1 * time.Hour
+)
+
+// Record is what a Store keeps: a json encodable value and when it happened.
+type Record interface {
+	Time() time.Time
+}
+
+// Store keeps records in memory and appends them to a json lines file, so
+// they survive restarts. Records older than retention are dropped. It is
+// shared by the history and the audit, which decode their own records.
+type Store struct {
+	sync.Mutex
+	path      string
+	retention time.Duration
+	decode    func([]byte) (Record, error)
+	logger    *logging.Logger
+	records   []Record
+	file      *os.File
+	lastPrune time.Time
+}
+
+// Open loads the records in path, using decode for each line, and keeps
+// appending to it. Problems are logged with logger.
+func Open(path string, retention time.Duration, decode func([]byte) (Record, error),
+	logger *logging.Logger) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	s := Store{path: path, retention: retention, decode: decode, logger: logger}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.prune(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Store) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r, err := s.decode(scanner.Bytes())
+		if err != nil {
+			// likely a partial write from a crash; skip it
+			s.logger.Warnf("Ignoring bad line in %s: %v", s.path, err)
+			continue
+		}
+		s.records = append(s.records, r)
+	}
+	sort.SliceStable(s.records, func(i, j int) bool { return s.records[i].Time().Before(s.records[j].Time()) })
+	return scanner.Err()
+}
+
+// prune drops expired records and rewrites the file with the ones left.
+func (s *Store) prune() error {
+	s.lastPrune = time.Now()
+	cutoff := s.lastPrune.Add(-s.retention)
+	firstKept := sort.Search(len(s.records), func(i int) bool { return !s.records[i].Time().Before(cutoff) })
+	if firstKept == 0 && s.file != nil {
+		return nil
+	}
+	s.records = append([]Record(nil), s.records[firstKept:]...)
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range s.records {
+		if err = enc.Encode(r); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	return err
+}
+
+// Append adds a record, which should be timestamped now.
+func (s *Store) Append(r Record) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.records = append(s.records, r)
+	if s.file != nil {
+		data, _ := json.Marshal(r)
+		if _, err := s.file.Write(append(data, '\n')); err != nil {
+			s.logger.Errorf("Unable to write %+v to %s: %v", r, s.path, err)
+		}
+	}
+	if time.Since(s.lastPrune) > pruneInterval {
+		if err := s.prune(); err != nil {
+			s.logger.Errorf("Unable to prune %s: %v", s.path, err)
+		}
+	}
+}
+
+// Query returns the records between from and to (inclusive), oldest first,
+// for which match is true. A nil match takes all of them.
+func (s *Store) Query(from, to time.Time, match func(Record) bool) []Record {
+	s.Lock()
+	defer s.Unlock()
+
+	var result []Record
+	for _, r := range s.records {
+		if r.Time().Before(from) || r.Time().After(to) {
+			continue
+		}
+		if match != nil && !match(r) {
+			continue
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+func (s *Store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
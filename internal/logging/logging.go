@@ -0,0 +1,273 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelTrace Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+const (
+	FormatLogfmt = "logfmt"
+	FormatJson   = "json"
+
+	DefLogFile     = "smokey.log"
+	DefMaxFileSize = 4 * 1024 * 1024
+	DefMaxFiles    = 20
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelTrace:
+		return "trace"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	case LevelFatal:
+		return "fatal"
+	}
+	return "unknown"
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "trace", "debug":
+		return LevelTrace, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("bad log level %q. Use trace, info, warn or error", s)
+}
+
+// ParseLevels takes a default level and levels per subsystem, like
+// "info,mqtt=trace,web=warn". The default level is kept under "".
+func ParseLevels(spec string) (map[string]Level, error) {
+	levels := map[string]Level{"": LevelInfo}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, levelStr := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			subsystem, levelStr = strings.ToLower(part[:i]), part[i+1:]
+			if subsystem == "" {
+				return nil, fmt.Errorf("bad log level %q: no subsystem before =", part)
+			}
+		}
+		level, err := ParseLevel(levelStr)
+		if err != nil {
+			return nil, err
+		}
+		levels[subsystem] = level
+	}
+	return levels, nil
+}
+
+// Config is where and how logs are written. Levels has the level for each
+// subsystem, under "" for the ones not listed. With Stdout, logs go to
+// stdout (e.g. for journald) instead of rotating files in Dir. Fields are
+// added to every line, e.g. the device.
+type Config struct {
+	Format      string
+	Levels      map[string]Level
+	Stdout      bool
+	Dir         string
+	MaxFileSize int64
+	MaxFiles    int
+	Fields      map[string]string
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes the logs of a subsystem, e.g. "manager" or "web"
+type Logger struct {
+	subsystem string
+	fields    []field
+}
+
+type output struct {
+	sync.Mutex
+	w      io.Writer
+	format string
+	levels map[string]Level
+	fields []field
+}
+
+// until Init is called, logs go to stderr
+var gOutput = output{w: os.Stderr, format: FormatLogfmt, levels: map[string]Level{"": LevelInfo}}
+
+func Init(config *Config) error {
+	var w io.Writer = os.Stdout
+	if !config.Stdout {
+		rf, err := newRotatingFile(config.Dir, DefLogFile, config.MaxFileSize, config.MaxFiles)
+		if err != nil {
+			return err
+		}
+		w = rf
+	}
+	format := strings.ToLower(config.Format)
+	if format == "" {
+		format = FormatLogfmt
+	}
+	if format != FormatLogfmt && format != FormatJson {
+		return fmt.Errorf("bad log format %q. Use %s or %s", config.Format, FormatLogfmt, FormatJson)
+	}
+	levels := map[string]Level{"": LevelInfo}
+	for subsystem, level := range config.Levels {
+		levels[strings.ToLower(subsystem)] = level
+	}
+	var fields []field
+	for key, value := range config.Fields {
+		fields = append(fields, field{key, value})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+
+	gOutput.Lock()
+	defer gOutput.Unlock()
+	gOutput.w, gOutput.format, gOutput.levels, gOutput.fields = w, format, levels, fields
+	return nil
+}
+
+func New(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// With gives a logger that adds key=value to every line
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{subsystem: l.subsystem, fields: append(fields, field{key, value})}
+}
+
+func (l *Logger) enabled(level Level) bool {
+	wanted, found := gOutput.levels[l.subsystem]
+	if !found {
+		wanted = gOutput.levels[""]
+	}
+	return level >= wanted
+}
+
+func (l *Logger) log(level Level, msg string) {
+	gOutput.Lock()
+	defer gOutput.Unlock()
+	if !l.enabled(level) {
+		return
+	}
+	fields := []field{
+		{"ts", time.Now().Format(time.RFC3339Nano)},
+		{"level", level.String()},
+		{"subsystem", l.subsystem},
+	}
+	fields = append(fields, gOutput.fields...)
+	fields = append(fields, field{"msg", msg})
+	fields = append(fields, l.fields...)
+
+	var line []byte
+	if gOutput.format == FormatJson {
+		line = jsonLine(fields)
+	} else {
+		line = logfmtLine(fields)
+	}
+	gOutput.w.Write(line)
+}
+
+func jsonLine(fields []field) []byte {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(f.value))
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+func logfmtLine(fields []field) []byte {
+	var b strings.Builder
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		value := fmt.Sprint(f.value)
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		b.WriteString(value)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func (l *Logger) Trace(args ...interface{}) { l.log(LevelTrace, sprint(args)) }
+func (l *Logger) Info(args ...interface{})  { l.log(LevelInfo, sprint(args)) }
+func (l *Logger) Warn(args ...interface{})  { l.log(LevelWarn, sprint(args)) }
+func (l *Logger) Error(args ...interface{}) { l.log(LevelError, sprint(args)) }
+
+func (l *Logger) Tracef(format string, args ...interface{}) {
+	l.log(LevelTrace, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, fmt.Sprintf(format, args...))
+}
+
+// Fatal logs and exits
+func (l *Logger) Fatal(args ...interface{}) {
+	l.log(LevelFatal, sprint(args))
+	os.Exit(1)
+}
+
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log(LevelFatal, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// sprint puts spaces between all args, like fmt.Sprintln without the newline
+func sprint(args []interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+}
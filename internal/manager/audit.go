@@ -0,0 +1,21 @@
+package manager
+
+import (
+	"github.com/flavio-fernandes/smokey/internal/audit"
+)
+
+// recordAudit records a change smokey makes on its own, e.g. an auto off
+// or a reconcile. Changes asked for with the api are recorded by web.
+func (m *Manager) recordAudit(source, action, details string) {
+	if m.audit == nil {
+		return
+	}
+	m.audit.Record(audit.Entry{Source: source, Action: action, Details: details})
+}
+
+func onOffAction(component string, on bool) string {
+	if on {
+		return component + " on"
+	}
+	return component + " off"
+}
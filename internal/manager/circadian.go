@@ -0,0 +1,128 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// how often circadian mode looks at the time of day, and how long it
+	// takes to glide to the new color and dim
+	circadianInterval       = 2 * time.Minute
+	circadianTransitionSecs = 60
+)
+
+// CircadianPoint is the light wanted at a time of day (local, as "15:04").
+// Between points, kelvin and dim change linearly.
+type CircadianPoint struct {
+	Time   string
+	Kelvin int
+	Dim    int
+}
+
+// DefaultCircadianCurve is used when the config file has no Circadian
+// section: very dim amber at night, cool and bright at midday and warm and
+// dim in the evening.
+var DefaultCircadianCurve = []CircadianPoint{
+	{Time: "00:00", Kelvin: 1800, Dim: 3},
+	{Time: "06:00", Kelvin: 1800, Dim: 3},
+	{Time: "08:00", Kelvin: 3500, Dim: 60},
+	{Time: "12:00", Kelvin: 6500, Dim: 100},
+	{Time: "17:00", Kelvin: 4500, Dim: 80},
+	{Time: "20:00", Kelvin: 2700, Dim: 40},
+	{Time: "22:00", Kelvin: 2000, Dim: 15},
+}
+
+type circadianPoint struct {
+	minute int
+	kelvin float64
+	dim    float64
+}
+
+func parseCircadianCurve(points []CircadianPoint) ([]circadianPoint, error) {
+	if len(points) == 0 {
+		return nil, fmt.Errorf("circadian curve has no points")
+	}
+	var curve []circadianPoint
+	seen := make(map[int]bool)
+	for _, p := range points {
+		t, err := time.Parse("15:04", p.Time)
+		if err != nil {
+			return nil, fmt.Errorf("bad circadian time %q: use HH:MM", p.Time)
+		}
+		minute := t.Hour()*60 + t.Minute()
+		if seen[minute] {
+			return nil, fmt.Errorf("circadian time %s is given more than once", p.Time)
+		}
+		seen[minute] = true
+		if p.Kelvin < 1000 || p.Kelvin > 40000 {
+			return nil, fmt.Errorf("bad circadian kelvin %d at %s. Should be between 1000 and 40000", p.Kelvin, p.Time)
+		}
+		if p.Dim < 1 || p.Dim > 100 {
+			return nil, fmt.Errorf("bad circadian dim %d at %s. Should be between 1 and 100", p.Dim, p.Time)
+		}
+		curve = append(curve, circadianPoint{minute: minute, kelvin: float64(p.Kelvin), dim: float64(p.Dim)})
+	}
+	sort.Slice(curve, func(i, j int) bool { return curve[i].minute < curve[j].minute })
+	return curve, nil
+}
+
+// ValidateCircadian checks the curve from the config file, so mistakes are
+// caught on start.
+func ValidateCircadian(points []CircadianPoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+	_, err := parseCircadianCurve(points)
+	return err
+}
+
+// circadianAt gives the kelvin and dim for the time of day, going around
+// midnight from the last point of the curve to the first.
+func circadianAt(curve []circadianPoint, now time.Time) (int, int) {
+	const day = 24 * 60
+	minute := float64(now.Hour()*60+now.Minute()) + float64(now.Second())/60
+	i := sort.Search(len(curve), func(i int) bool { return float64(curve[i].minute) > minute })
+	prev, next := curve[(i+len(curve)-1)%len(curve)], curve[i%len(curve)]
+	span := math.Mod(float64(next.minute-prev.minute)+day, day)
+	ratio := 0.0
+	if span > 0 {
+		ratio = math.Mod(minute-float64(prev.minute)+day, day) / span
+	}
+	kelvin := prev.kelvin + (next.kelvin-prev.kelvin)*ratio
+	dim := prev.dim + (next.dim-prev.dim)*ratio
+	return int(math.Round(kelvin)), int(math.Round(dim))
+}
+
+// updateCircadian sets the color and dim for the time of day. With
+// transitionSecs, it glides there instead of jumping.
+func (m *Manager) updateCircadian(transitionSecs int) {
+	kelvin, dim := circadianAt(m.circadian, time.Now())
+	rgb := kelvinToRGB(float64(kelvin))
+	logger.Tracef("Circadian light is %dK (#%06x) at dim %d", kelvin, rgb, dim)
+	if transitionSecs <= 0 {
+		m.pubEffectColor(rgb)
+		m.pubEffectDim(dim)
+		return
+	}
+	if rgb != m.state.WantedState.LightColor {
+		m.effect.colorTransition = newTransition(m.state.WantedState.LightColor, rgb, transitionSecs)
+	}
+	if dim != m.state.WantedState.LightDim {
+		m.effect.dimTransition = newTransition(m.state.WantedState.LightDim, dim, transitionSecs)
+	}
+}
+
+// checkCircadian follows the curve while the light is on. It leaves the
+// dim alone while fading out before the auto off.
+func (m *Manager) checkCircadian() {
+	if m.state.WantedState.LightMode != Circadian ||
+		!m.state.WantedState.LightOn ||
+		!m.state.OperStateParsed.LightOn ||
+		m.effect.fadingOut {
+		return
+	}
+	m.updateCircadian(circadianTransitionSecs)
+}
@@ -0,0 +1,39 @@
+package manager
+
+import (
+	"github.com/flavio-fernandes/smokey/internal/mqtt_agent"
+	"testing"
+)
+
+func TestCircadianKeepsFadeOut(t *testing.T) {
+	curve, err := parseCircadianCurve([]CircadianPoint{{Time: "00:00", Kelvin: 2700, Dim: 90}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Manager{circadian: curve, mqttPub: make(chan mqtt_agent.Msg, 16)}
+	w, o := &m.state.WantedState, &m.state.OperStateParsed
+	w.LightOn, w.LightMode, w.LightDim, w.LightDimOn = true, Circadian, 50, true
+	w.LightAutoOffSecs, w.LightEffect.FadeOutSecs = 600, 120
+	o.LightOn, o.LightOnSecs = true, 500
+
+	m.checkFadeOut()
+	if !m.effect.fadingOut || m.effect.dimTransition.to != 1 {
+		t.Fatalf("expected fade out to dim 1, got fading %v to %d", m.effect.fadingOut, m.effect.dimTransition.to)
+	}
+	m.checkCircadian()
+	if m.effect.dimTransition.to != 1 {
+		t.Errorf("circadian replaced the fade out with a transition to dim %d", m.effect.dimTransition.to)
+	}
+	if m.effect.colorTransition.active() {
+		t.Errorf("circadian started a color transition while fading out")
+	}
+
+	// with the auto off moved away, circadian takes over again
+	w.LightAutoOffSecs = 3600
+	m.checkFadeOut()
+	m.checkCircadian()
+	if m.effect.fadingOut || m.effect.dimTransition.to != 90 {
+		t.Errorf("expected circadian transition to dim 90, got fading %v to %d",
+			m.effect.fadingOut, m.effect.dimTransition.to)
+	}
+}
@@ -0,0 +1,405 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const (
+	LightColorRandom = LightColor("random")
+	LightColorWhite  = LightColor("white")
+
+	minKelvin = 1000
+	maxKelvin = 40000
+)
+
+// legacyColors are the names smokey understood before it knew about css
+// colors. Some differ from css (e.g. green is css lime) and win over it, so
+// existing automations keep their colors.
+var legacyColors = map[string]int{
+	"out":     0,
+	"none":    0,
+	"off":     0,
+	"black":   0,
+	"red":     0xff0000,
+	"green":   0x00ff00,
+	"blue":    0x0000ff,
+	"yellow":  0xffff00,
+	"cyan":    0x00ffff,
+	"magenta": 0xff00ff,
+	"purple":  0x4b0082,
+	"pink":    0xff1493,
+	"orange":  0xff8c00,
+	"brown":   0x8b4513,
+	"gold":    0xd4af37,
+	"snow":    0xfffafa,
+	"azure":   0xf0ffff,
+	"white":   0xffffff,
+}
+
+// https://www.w3.org/TR/css-color-4/#named-colors
+var cssColors = map[string]int{
+	"aliceblue":            0xf0f8ff,
+	"antiquewhite":         0xfaebd7,
+	"aqua":                 0x00ffff,
+	"aquamarine":           0x7fffd4,
+	"azure":                0xf0ffff,
+	"beige":                0xf5f5dc,
+	"bisque":               0xffe4c4,
+	"black":                0x000000,
+	"blanchedalmond":       0xffebcd,
+	"blue":                 0x0000ff,
+	"blueviolet":           0x8a2be2,
+	"brown":                0xa52a2a,
+	"burlywood":            0xdeb887,
+	"cadetblue":            0x5f9ea0,
+	"chartreuse":           0x7fff00,
+	"chocolate":            0xd2691e,
+	"coral":                0xff7f50,
+	"cornflowerblue":       0x6495ed,
+	"cornsilk":             0xfff8dc,
+	"crimson":              0xdc143c,
+	"cyan":                 0x00ffff,
+	"darkblue":             0x00008b,
+	"darkcyan":             0x008b8b,
+	"darkgoldenrod":        0xb8860b,
+	"darkgray":             0xa9a9a9,
+	"darkgreen":            0x006400,
+	"darkgrey":             0xa9a9a9,
+	"darkkhaki":            0xbdb76b,
+	"darkmagenta":          0x8b008b,
+	"darkolivegreen":       0x556b2f,
+	"darkorange":           0xff8c00,
+	"darkorchid":           0x9932cc,
+	"darkred":              0x8b0000,
+	"darksalmon":           0xe9967a,
+	"darkseagreen":         0x8fbc8f,
+	"darkslateblue":        0x483d8b,
+	"darkslategray":        0x2f4f4f,
+	"darkslategrey":        0x2f4f4f,
+	"darkturquoise":        0x00ced1,
+	"darkviolet":           0x9400d3,
+	"deeppink":             0xff1493,
+	"deepskyblue":          0x00bfff,
+	"dimgray":              0x696969,
+	"dimgrey":              0x696969,
+	"dodgerblue":           0x1e90ff,
+	"firebrick":            0xb22222,
+	"floralwhite":          0xfffaf0,
+	"forestgreen":          0x228b22,
+	"fuchsia":              0xff00ff,
+	"gainsboro":            0xdcdcdc,
+	"ghostwhite":           0xf8f8ff,
+	"gold":                 0xffd700,
+	"goldenrod":            0xdaa520,
+	"gray":                 0x808080,
+	"green":                0x008000,
+	"greenyellow":          0xadff2f,
+	"grey":                 0x808080,
+	"honeydew":             0xf0fff0,
+	"hotpink":              0xff69b4,
+	"indianred":            0xcd5c5c,
+	"indigo":               0x4b0082,
+	"ivory":                0xfffff0,
+	"khaki":                0xf0e68c,
+	"lavender":             0xe6e6fa,
+	"lavenderblush":        0xfff0f5,
+	"lawngreen":            0x7cfc00,
+	"lemonchiffon":         0xfffacd,
+	"lightblue":            0xadd8e6,
+	"lightcoral":           0xf08080,
+	"lightcyan":            0xe0ffff,
+	"lightgoldenrodyellow": 0xfafad2,
+	"lightgray":            0xd3d3d3,
+	"lightgreen":           0x90ee90,
+	"lightgrey":            0xd3d3d3,
+	"lightpink":            0xffb6c1,
+	"lightsalmon":          0xffa07a,
+	"lightseagreen":        0x20b2aa,
+	"lightskyblue":         0x87cefa,
+	"lightslategray":       0x778899,
+	"lightslategrey":       0x778899,
+	"lightsteelblue":       0xb0c4de,
+	"lightyellow":          0xffffe0,
+	"lime":                 0x00ff00,
+	"limegreen":            0x32cd32,
+	"linen":                0xfaf0e6,
+	"magenta":              0xff00ff,
+	"maroon":               0x800000,
+	"mediumaquamarine":     0x66cdaa,
+	"mediumblue":           0x0000cd,
+	"mediumorchid":         0xba55d3,
+	"mediumpurple":         0x9370db,
+	"mediumseagreen":       0x3cb371,
+	"mediumslateblue":      0x7b68ee,
+	"mediumspringgreen":    0x00fa9a,
+	"mediumturquoise":      0x48d1cc,
+	"mediumvioletred":      0xc71585,
+	"midnightblue":         0x191970,
+	"mintcream":            0xf5fffa,
+	"mistyrose":            0xffe4e1,
+	"moccasin":             0xffe4b5,
+	"navajowhite":          0xffdead,
+	"navy":                 0x000080,
+	"oldlace":              0xfdf5e6,
+	"olive":                0x808000,
+	"olivedrab":            0x6b8e23,
+	"orange":               0xffa500,
+	"orangered":            0xff4500,
+	"orchid":               0xda70d6,
+	"palegoldenrod":        0xeee8aa,
+	"palegreen":            0x98fb98,
+	"paleturquoise":        0xafeeee,
+	"palevioletred":        0xdb7093,
+	"papayawhip":           0xffefd5,
+	"peachpuff":            0xffdab9,
+	"peru":                 0xcd853f,
+	"pink":                 0xffc0cb,
+	"plum":                 0xdda0dd,
+	"powderblue":           0xb0e0e6,
+	"purple":               0x800080,
+	"rebeccapurple":        0x663399,
+	"red":                  0xff0000,
+	"rosybrown":            0xbc8f8f,
+	"royalblue":            0x4169e1,
+	"saddlebrown":          0x8b4513,
+	"salmon":               0xfa8072,
+	"sandybrown":           0xf4a460,
+	"seagreen":             0x2e8b57,
+	"seashell":             0xfff5ee,
+	"sienna":               0xa0522d,
+	"silver":               0xc0c0c0,
+	"skyblue":              0x87ceeb,
+	"slateblue":            0x6a5acd,
+	"slategray":            0x708090,
+	"slategrey":            0x708090,
+	"snow":                 0xfffafa,
+	"springgreen":          0x00ff7f,
+	"steelblue":            0x4682b4,
+	"tan":                  0xd2b48c,
+	"teal":                 0x008080,
+	"thistle":              0xd8bfd8,
+	"tomato":               0xff6347,
+	"turquoise":            0x40e0d0,
+	"violet":               0xee82ee,
+	"wheat":                0xf5deb3,
+	"white":                0xffffff,
+	"whitesmoke":           0xf5f5f5,
+	"yellow":               0xffff00,
+	"yellowgreen":          0x9acd32,
+}
+
+func rgbInt(r, g, b float64) int {
+	clamp := func(v float64) int {
+		return int(math.Round(math.Max(0, math.Min(255, v))))
+	}
+	return clamp(r)<<16 + clamp(g)<<8 + clamp(b)
+}
+
+func splitRGB(color int) (float64, float64, float64) {
+	return float64(color >> 16 & 0xff), float64(color >> 8 & 0xff), float64(color & 0xff)
+}
+
+// hsbToRGB takes hue in degrees, saturation and brightness in 0..1
+func hsbToRGB(h, s, v float64) int {
+	h = math.Mod(math.Mod(h, 360)+360, 360) / 60
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h, 2)-1))
+	var r, g, b float64
+	switch int(h) {
+	case 0:
+		r, g, b = c, x, 0
+	case 1:
+		r, g, b = x, c, 0
+	case 2:
+		r, g, b = 0, c, x
+	case 3:
+		r, g, b = 0, x, c
+	case 4:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	m := v - c
+	return rgbInt((r+m)*255, (g+m)*255, (b+m)*255)
+}
+
+// hslToRGB takes hue in degrees, saturation and lightness in 0..1
+func hslToRGB(h, s, l float64) int {
+	v := l + s*math.Min(l, 1-l)
+	sv := 0.0
+	if v > 0 {
+		sv = 2 * (1 - l/v)
+	}
+	return hsbToRGB(h, sv, v)
+}
+
+// kelvinToRGB approximates the color of a black body at the given
+// temperature. https://tannerhelland.com/2012/09/18/convert-temperature-rgb-algorithm-code.html
+func kelvinToRGB(kelvin float64) int {
+	t := kelvin / 100
+	var r, g, b float64
+	if t <= 66 {
+		r = 255
+		g = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(t-60, -0.1332047592)
+		g = 288.1221695283 * math.Pow(t-60, -0.0755148492)
+	}
+	if t >= 66 {
+		b = 255
+	} else if t <= 19 {
+		b = 0
+	} else {
+		b = 138.5177312231*math.Log(t-10) - 305.0447927307
+	}
+	return rgbInt(r, g, b)
+}
+
+// oklab converts to the Oklab color space (https://bottosson.github.io/posts/oklab/),
+// where the same distance looks like the same change of color.
+func oklab(color int) (float64, float64, float64) {
+	toLinear := func(v float64) float64 {
+		v /= 255
+		if v <= 0.04045 {
+			return v / 12.92
+		}
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+	r, g, b := splitRGB(color)
+	r, g, b = toLinear(r), toLinear(g), toLinear(b)
+	l := math.Cbrt(0.4122214708*r + 0.5363325363*g + 0.0514459929*b)
+	m := math.Cbrt(0.2119034982*r + 0.6806995451*g + 0.1073969566*b)
+	s := math.Cbrt(0.0883024619*r + 0.2817188376*g + 0.6299787005*b)
+	return 0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		0.0259040371*l + 0.7827717662*m - 0.8086757660*s
+}
+
+func oklabToRGB(L, a, b float64) int {
+	fromLinear := func(v float64) float64 {
+		if v <= 0.0031308 {
+			return v * 12.92 * 255
+		}
+		return (1.055*math.Pow(v, 1/2.4) - 0.055) * 255
+	}
+	l := math.Pow(L+0.3963377774*a+0.2158037573*b, 3)
+	m := math.Pow(L-0.1055613458*a-0.0638541728*b, 3)
+	s := math.Pow(L-0.0894841775*a-1.2914855480*b, 3)
+	return rgbInt(fromLinear(+4.0767416621*l-3.3077115913*m+0.2309699292*s),
+		fromLinear(-1.2684380046*l+2.6097574011*m-0.3413193965*s),
+		fromLinear(-0.0041960863*l-0.7034186147*m+1.7076147010*s))
+}
+
+// mixOklab gives the color at ratio (0 to 1) of the way from one color to
+// the other, mixing them in Oklab so the steps in between look even.
+func mixOklab(from, to int, ratio float64) int {
+	L1, a1, b1 := oklab(from)
+	L2, a2, b2 := oklab(to)
+	return oklabToRGB(L1+(L2-L1)*ratio, a1+(a2-a1)*ratio, b1+(b2-b1)*ratio)
+}
+
+// colorArgs parses the numbers in "name(a, b, c)". Values may end with %,
+// in which case they are scaled to max.
+func colorArgs(s, name string, max [3]float64) ([3]float64, error) {
+	var result [3]float64
+	if !strings.HasSuffix(s, ")") {
+		return result, fmt.Errorf("missing ) in %s", s)
+	}
+	inner := strings.TrimSuffix(strings.TrimPrefix(s, name+"("), ")")
+	parts := strings.FieldsFunc(inner, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(parts) != 3 {
+		return result, fmt.Errorf("%s needs 3 values: %s", name, s)
+	}
+	for i, part := range parts {
+		percent := strings.HasSuffix(part, "%")
+		v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSuffix(part, "%"), "deg"), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return result, fmt.Errorf("bad value %q in %s", part, s)
+		}
+		if percent {
+			v = v * max[i] / 100
+		}
+		if i > 0 || name == "rgb" {
+			if v < 0 || v > max[i] {
+				return result, fmt.Errorf("value %q out of range in %s", part, s)
+			}
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+// Parse converts the color to its rgb value. It understands css color
+// names, #rrggbb, #rgb, 0xrrggbb, decimal numbers, rgb(r,g,b), hsb(h,s,b),
+// hsl(h,s,l), color temperatures like 2700K and random. Names from the
+// palette need Manager.ParseColor.
+func (c LightColor) Parse() (int, error) {
+	s := strings.ToLower(strings.TrimSpace(string(c)))
+	if s == "" {
+		return 0, fmt.Errorf("empty color")
+	}
+	if s == string(LightColorRandom) {
+		red, green, blue := rand.Intn(256), rand.Intn(256), rand.Intn(256)
+		return blue + green<<8 + red<<16, nil
+	}
+	if value, found := legacyColors[s]; found {
+		return value, nil
+	}
+	if value, found := cssColors[s]; found {
+		return value, nil
+	}
+
+	switch {
+	case strings.HasPrefix(s, "#"):
+		hex := s[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		if len(hex) != 6 {
+			break
+		}
+		if value, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return int(value), nil
+		}
+	case strings.HasPrefix(s, "0x"):
+		if value, err := strconv.ParseUint(s[2:], 16, 32); err == nil && value <= 0xffffff {
+			return int(value), nil
+		}
+	case strings.HasPrefix(s, "rgb("):
+		v, err := colorArgs(s, "rgb", [3]float64{255, 255, 255})
+		if err != nil {
+			return 0, err
+		}
+		return rgbInt(v[0], v[1], v[2]), nil
+	case strings.HasPrefix(s, "hsb("), strings.HasPrefix(s, "hsv("):
+		v, err := colorArgs(s, s[:3], [3]float64{360, 100, 100})
+		if err != nil {
+			return 0, err
+		}
+		return hsbToRGB(v[0], v[1]/100, v[2]/100), nil
+	case strings.HasPrefix(s, "hsl("):
+		v, err := colorArgs(s, "hsl", [3]float64{360, 100, 100})
+		if err != nil {
+			return 0, err
+		}
+		return hslToRGB(v[0], v[1]/100, v[2]/100), nil
+	case strings.HasSuffix(s, "k"):
+		kelvin, err := strconv.ParseFloat(strings.TrimSpace(s[:len(s)-1]), 64)
+		if err != nil || math.IsNaN(kelvin) {
+			break
+		}
+		if kelvin < minKelvin || kelvin > maxKelvin {
+			return 0, fmt.Errorf("color temperature %s should be between %dK and %dK", s, minKelvin, maxKelvin)
+		}
+		return kelvinToRGB(kelvin), nil
+	default:
+		if value, err := strconv.ParseInt(s, 10, 32); err == nil && value >= 0 && value <= 0xffffff {
+			return int(value), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown color %q", string(c))
+}
@@ -0,0 +1,64 @@
+package manager
+
+import "testing"
+
+func TestLightColorParse(t *testing.T) {
+	valid := []struct {
+		color LightColor
+		want  int
+	}{
+		{"red", 0xff0000},
+		{" Red ", 0xff0000},
+		{"green", 0x00ff00}, // legacy name wins over css
+		{"aliceblue", 0xf0f8ff},
+		{"#ff8000", 0xff8000},
+		{"#F80", 0xff8800},
+		{"0xff8000", 0xff8000},
+		{"16711680", 0xff0000},
+		{"rgb(255, 128, 0)", 0xff8000},
+		{"rgb(100%,0%,0%)", 0xff0000},
+		{"hsb(120, 100, 100)", 0x00ff00},
+		{"hsv(0,100%,100%)", 0xff0000},
+		{"hsl(240deg, 100%, 50%)", 0x0000ff},
+		{"6600K", 0xffffff},
+	}
+	for _, tc := range valid {
+		got, err := tc.color.Parse()
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tc.color, err)
+		} else if got != tc.want {
+			t.Errorf("%q: got %06x, want %06x", tc.color, got, tc.want)
+		}
+	}
+
+	if got, err := LightColorRandom.Parse(); err != nil || got < 0 || got > 0xffffff {
+		t.Errorf("random: got %x, %v", got, err)
+	}
+
+	invalid := []LightColor{
+		"",
+		"nope",
+		"#ff80",
+		"#-12345",
+		"0x-ff",
+		"0x1000000",
+		"-1",
+		"16777216",
+		"rgb(1,2,3",
+		"rgb(1,2)",
+		"rgb(256,0,0)",
+		"rgb(nan,0,0)",
+		"rgb(inf,0,0)",
+		"hsl(nan,50,50)",
+		"hsb(0,101,50)",
+		"nank",
+		"infk",
+		"500K",
+		"50000k",
+	}
+	for _, color := range invalid {
+		if got, err := color.Parse(); err == nil {
+			t.Errorf("%q: expected an error, got %06x", color, got)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package manager
+
+import (
+	"github.com/flavio-fernandes/smokey/internal/mqtt_agent"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultCycleIntervalSecs = 5
+	DefaultBreatheMinDim     = 10
+	DefaultBreatheMaxDim     = 100
+	DefaultBreatheBpm        = 6.0
+	// with one dim per second, faster breaths would be too choppy
+	MaxBreatheBpm = 20.0
+	// effects never publish more often than this, so the broker and the
+	// device are not flooded
+	effectMinPubInterval = 1 * time.Second
+
+	// candle flame colors go from candleMinKelvin, when the flame is at its
+	// dimmest, to candleMaxKelvin at full brightness
+	candleMinKelvin     = 1700
+	candleMaxKelvin     = 2300
+	candleKelvinJitter  = 100
+	candleDipChance     = 0.15
+	candleMinBrightness = 0.45
+)
+
+// LightEffect holds the parameters of what smokey drives itself, by
+// publishing colors and dims, instead of the device: the light modes done by
+// smokey and the fade out before auto off, which works in any mode.
+type LightEffect struct {
+	Colors       []string `json:",omitempty"`
+	IntervalSecs int      `json:",omitempty"`
+	Crossfade    bool     `json:",omitempty"`
+	MinDim       int      `json:",omitempty"`
+	MaxDim       int      `json:",omitempty"`
+	Bpm          float64  `json:",omitempty"`
+	FadeOutSecs  int      `json:",omitempty"`
+}
+
+// effectState is what a running effect keeps between ticks
+type effectState struct {
+	cycleRgb   []int
+	cycleIndex int
+	stepTs     time.Time
+	lastPubTs  time.Time
+	lastRgb    int
+	lastDim    int
+
+	colorTransition transition
+	dimTransition   transition
+	fadingOut       bool
+	fadeFromDim     int
+}
+
+// startLightEffect is called whenever the light is (re)turned on, so the
+// effect starts from its first step.
+func (m *Manager) startLightEffect(mode LightMode) {
+	m.effect = effectState{stepTs: time.Now(), lastRgb: -1, lastDim: -1}
+	if mode != Cycle {
+		return
+	}
+	for _, color := range m.state.WantedState.LightEffect.Colors {
+		m.effect.cycleRgb = append(m.effect.cycleRgb, m.colorInt(LightColor(color)))
+	}
+	if len(m.effect.cycleRgb) > 0 {
+		m.effect.lastRgb = m.effect.cycleRgb[0]
+	}
+}
+
+func (m *Manager) runLightEffect() {
+	now := time.Now()
+	if !m.state.WantedState.LightOn || !m.state.OperStateParsed.LightOn {
+		return
+	}
+	// transitions asked for with /lightcolor and /lightdim come first
+	if m.stepTransitions(now) ||
+		now.Sub(m.effect.lastPubTs).Round(time.Second) < effectMinPubInterval {
+		return
+	}
+	switch m.state.WantedState.LightMode {
+	case Cycle:
+		m.stepColorCycle(now)
+	case Candle:
+		m.stepCandle()
+	case Breathe:
+		m.stepBreathe(now)
+	}
+}
+
+func (m *Manager) pubEffectColor(rgb int) {
+	if rgb == m.effect.lastRgb {
+		return
+	}
+	var msg mqtt_agent.Msg
+	msg.Topic, msg.Payload = mqtt_agent.MsgPubSetLightColor(rgb)
+	m.mqttPub <- msg
+	logger.Tracef("Light effect %s set color to %s", m.state.WantedState.LightModeName, msg.Payload)
+	m.state.WantedState.LightColor = rgb
+	m.effect.lastRgb = rgb
+	m.effect.lastPubTs = time.Now()
+}
+
+func (m *Manager) pubEffectDim(dim int) {
+	if dim == m.effect.lastDim {
+		return
+	}
+	var msg mqtt_agent.Msg
+	msg.Topic, msg.Payload = mqtt_agent.MsgPubSetLightDim(dim)
+	m.mqttPub <- msg
+	logger.Tracef("Light effect %s set dim to %s", m.state.WantedState.LightModeName, msg.Payload)
+	m.state.WantedState.LightDim = dim
+	m.state.WantedState.LightDimOn = true
+	m.effect.lastDim = dim
+	m.effect.lastPubTs = time.Now()
+}
+
+func (m *Manager) stepColorCycle(now time.Time) {
+	colors := m.effect.cycleRgb
+	if len(colors) < 2 {
+		return
+	}
+	interval := time.Duration(m.state.WantedState.LightEffect.IntervalSecs) * time.Second
+	if interval <= 0 {
+		interval = DefaultCycleIntervalSecs * time.Second
+	}
+	// rounded, since this runs from the second tick
+	elapsed := now.Sub(m.effect.stepTs).Round(time.Second)
+	if elapsed >= interval {
+		m.effect.cycleIndex = (m.effect.cycleIndex + 1) % len(colors)
+		m.effect.stepTs = now
+		elapsed = 0
+	}
+	from := colors[m.effect.cycleIndex]
+	if !m.state.WantedState.LightEffect.Crossfade {
+		m.pubEffectColor(from)
+		return
+	}
+	to := colors[(m.effect.cycleIndex+1)%len(colors)]
+	m.pubEffectColor(mixOklab(from, to, float64(elapsed)/float64(interval)))
+}
+
+// candleColor picks the next color of a candle flame: mostly bright with a
+// little flicker, sometimes dipping. Brightness is given by scaling the rgb
+// values, so a single message changes both color and brightness.
+func candleColor() int {
+	brightness := 0.75 + rand.Float64()*0.25
+	if rand.Float64() < candleDipChance {
+		brightness = candleMinBrightness + rand.Float64()*(0.75-candleMinBrightness)
+	}
+	ratio := (brightness - candleMinBrightness) / (1 - candleMinBrightness)
+	kelvin := candleMinKelvin + ratio*(candleMaxKelvin-candleMinKelvin) +
+		(rand.Float64()*2-1)*candleKelvinJitter
+	r, g, b := splitRGB(kelvinToRGB(kelvin))
+	return rgbInt(r*brightness, g*brightness, b*brightness)
+}
+
+func (m *Manager) stepCandle() {
+	m.pubEffectColor(candleColor())
+}
+
+// stepBreathe moves the dim along a sine wave, starting at the bottom of a
+// breath: MinDim is reached when breathing out and MaxDim when breathing in.
+func (m *Manager) stepBreathe(now time.Time) {
+	effect := &m.state.WantedState.LightEffect
+	minDim, maxDim, bpm := effect.MinDim, effect.MaxDim, effect.Bpm
+	if minDim <= 0 {
+		minDim = DefaultBreatheMinDim
+	}
+	if maxDim <= 0 {
+		maxDim = DefaultBreatheMaxDim
+	}
+	if bpm <= 0 {
+		bpm = DefaultBreatheBpm
+	}
+	phase := now.Sub(m.effect.stepTs).Minutes() * bpm * 2 * math.Pi
+	level := (1 - math.Cos(phase)) / 2
+	m.pubEffectDim(minDim + int(math.Round(level*float64(maxDim-minDim))))
+}
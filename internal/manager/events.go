@@ -0,0 +1,79 @@
+package manager
+
+import (
+	"time"
+)
+
+const (
+	EventLowWater       = "low-water"
+	EventRefilled       = "refilled"
+	EventWaterWarning   = "water-warning"
+	EventDeviceOffline  = "device-offline"
+	EventDeviceOnline   = "device-online"
+	EventAutoOffExpired = "auto-off-expired"
+	EventModeFinished   = "mode-finished"
+	EventManualChange   = "manual-change"
+
+	EventReconcileFault     = "reconcile-fault"
+	EventReconcileRecovered = "reconcile-recovered"
+	EventDeviceFault        = "device-fault"
+	EventDeviceFaultCleared = "device-fault-cleared"
+
+	// device is considered offline when nothing was heard from it for this
+	// long. Status is queried at least every 5 minutes.
+	deviceOfflineTimeout = 12 * time.Minute
+)
+
+var EventNames = []string{
+	EventLowWater,
+	EventRefilled,
+	EventWaterWarning,
+	EventDeviceOffline,
+	EventDeviceOnline,
+	EventAutoOffExpired,
+	EventModeFinished,
+	EventManualChange,
+	EventReconcileFault,
+	EventReconcileRecovered,
+	EventDeviceFault,
+	EventDeviceFaultCleared,
+}
+
+// Event is something noteworthy that happened to the device, handed to
+// Config.OnEvent (e.g. to fire webhooks).
+type Event struct {
+	Event   string
+	Ts      time.Time
+	Details map[string]interface{} `json:",omitempty"`
+}
+
+func (m *Manager) emitEvent(event string, details map[string]interface{}) {
+	logger.Tracef("emitting event %s %v", event, details)
+	if m.onEvent == nil {
+		return
+	}
+	m.onEvent(Event{Event: event, Ts: time.Now(), Details: details})
+}
+
+// deviceSeen is called for every message received from the device.
+func (m *Manager) deviceSeen() {
+	m.lastDeviceTs = time.Now()
+	if m.deviceOffline {
+		m.deviceOffline = false
+		logger.Info("Device is online again")
+		m.emitEvent(EventDeviceOnline, nil)
+	}
+}
+
+// checkDeviceOffline reports the device offline when nothing was heard
+// from it for a while. Since lastDeviceTs starts as the time manager
+// started, that also covers a device that was never reachable.
+func (m *Manager) checkDeviceOffline() {
+	if m.deviceOffline || time.Since(m.lastDeviceTs) < deviceOfflineTimeout {
+		return
+	}
+	m.deviceOffline = true
+	logger.Warnf("Device is offline: nothing heard from it since %s",
+		m.lastDeviceTs.Format(time.RFC1123))
+	m.emitEvent(EventDeviceOffline, map[string]interface{}{"LastSeen": m.lastDeviceTs})
+}
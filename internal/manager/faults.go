@@ -0,0 +1,96 @@
+package manager
+
+import (
+	"fmt"
+)
+
+// Fault is a bit of the device error value that is set
+type Fault struct {
+	Name  string
+	Bit   int
+	Since string
+}
+
+// DeviceFaults is the error value the device last reported, decoded with
+// the ErrorBits of the device profile. Bits the profile has no name for
+// are kept in UnknownBits, and recorded in the history as "bit-N".
+type DeviceFaults struct {
+	Value       int64
+	Active      []Fault
+	UnknownBits int64
+}
+
+// faultName is the name of an error bit, for the history and logs
+func (m *Manager) faultName(bit int) (string, bool) {
+	for name, b := range m.profile.ErrorBits {
+		if b == bit {
+			return name, true
+		}
+	}
+	return fmt.Sprintf("bit-%d", bit), false
+}
+
+// updateFaults records the error bits that got set or cleared since the
+// last error value.
+func (m *Manager) updateFaults(value int64) {
+	f := &m.state.Faults
+	changed := value ^ f.Value
+	if changed == 0 {
+		return
+	}
+	since := make(map[int]string)
+	for _, fault := range f.Active {
+		since[fault.Bit] = fault.Since
+	}
+	for bit := 0; bit < 63; bit++ {
+		mask := int64(1) << bit
+		if changed&mask == 0 {
+			continue
+		}
+		name, known := m.faultName(bit)
+		details := map[string]interface{}{"Fault": name, "Bit": bit}
+		if value&mask != 0 {
+			if known {
+				logger.Warnf("Device reports fault %s (bit %d)", name, bit)
+			} else {
+				logger.Warnf("Device reports unknown fault bit %d (error value %d)", bit, value)
+			}
+			since[bit] = ts()
+			m.recordHistory(historyFault, "set", name)
+			m.emitEvent(EventDeviceFault, details)
+		} else {
+			logger.Infof("Device fault %s (bit %d) is gone", name, bit)
+			m.recordHistory(historyFault, "cleared", name)
+			m.emitEvent(EventDeviceFaultCleared, details)
+		}
+	}
+
+	f.Value, f.Active, f.UnknownBits = value, []Fault{}, 0
+	for bit := 0; bit < 63; bit++ {
+		if value&(int64(1)<<bit) == 0 {
+			continue
+		}
+		if name, known := m.faultName(bit); known {
+			f.Active = append(f.Active, Fault{Name: name, Bit: bit, Since: since[bit]})
+		} else {
+			f.UnknownBits |= int64(1) << bit
+		}
+	}
+}
+
+// Faults gives the faults the device reports now
+func (m *Manager) Faults() DeviceFaults {
+	var faults DeviceFaults
+	cmd := sCommand{
+		f: func() *[]byte {
+			faults = m.state.Faults
+			faults.Active = append([]Fault{}, m.state.Faults.Active...)
+			return nil
+		},
+	}
+	cmd.Lock()
+	m.cmds <- &cmd
+	// wait for sCommand to unlock after getting response
+	cmd.Lock()
+	return faults
+}
@@ -0,0 +1,31 @@
+package manager
+
+const (
+	historyDiffuser = "diffuser"
+	historyLight    = "light"
+	historyWater    = "water"
+	historyMist     = "mist"
+	historyFault    = "fault"
+)
+
+func (m *Manager) recordHistory(component, event, value string) {
+	if m.history == nil {
+		return
+	}
+	m.history.Record(component, event, value)
+}
+
+// recordOnOff records transitions of the component. The first state seen is
+// always recorded, so a device that went off while smokey was not running
+// does not look like it stayed on.
+func (m *Manager) recordOnOff(component string, wasOn, on bool) {
+	if wasOn == on && m.historyKnown[component] {
+		return
+	}
+	m.historyKnown[component] = true
+	event := "off"
+	if on {
+		event = "on"
+	}
+	m.recordHistory(component, event, "")
+}
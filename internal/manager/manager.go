@@ -3,7 +3,9 @@ package manager
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/antigloss/go/logger"
+	"github.com/flavio-fernandes/smokey/internal/audit"
+	"github.com/flavio-fernandes/smokey/internal/history"
+	"github.com/flavio-fernandes/smokey/internal/logging"
 	"github.com/flavio-fernandes/smokey/internal/mqtt_agent"
 	"strconv"
 	"strings"
@@ -11,12 +13,11 @@ import (
 	"time"
 )
 
-var (
-	knownErrorValues = map[int64]struct{}{0: {}, 1: {}}
-)
+var logger = logging.New("manager")
 
 const (
 	cmdTsDampenInterval   = 6 * time.Second
+	lowWaterWaitInterval  = 5 * time.Second
 	DefaultAutoOffSeconds = 3600
 )
 
@@ -41,6 +42,8 @@ type OperStateParsed struct {
 	Uptime         string
 	Heap           int
 	LowWater       bool
+	MistMode       string
+	MistLevel      string
 	Raw            string
 	LastReceiveTs  string
 	DiffuserOnSecs int
@@ -58,8 +61,12 @@ type WantedState struct {
 	LightModeName       string
 	DiffuserAutoOffSecs int
 	LightAutoOffSecs    int
+	LightEffect         LightEffect
+	MistMode            string
+	MistLevel           string
 	DampenDiffuserTs    time.Time
 	DampenLightTs       time.Time
+	DampenMistTs        time.Time
 }
 
 type Stats struct {
@@ -95,46 +102,95 @@ func (sc *sCommand) run() {
 type State struct {
 	WantedState     WantedState
 	OperStateParsed OperStateParsed
+	Water           WaterEstimate
+	Timers          Timers
+	Reconcile       ReconcileState
+	Faults          DeviceFaults
 	Stats           Stats
 }
 
+type Config struct {
+	AdvertiseState bool
+	History        *history.Store
+	Audit          *audit.Store
+	WaterFile      string
+	ScheduledFile  string
+	Override       OverridePolicy
+	OnEvent        func(Event)
+	// Circadian is the curve for circadian mode. DefaultCircadianCurve
+	// is used when empty.
+	Circadian []CircadianPoint
+	// Profile maps commands to the device model. AsakukiProfile is used
+	// when it has no name.
+	Profile DeviceProfile
+	// Palette has the color names of the household, from LoadPalette
+	Palette Palette
+}
+
 type Manager struct {
 	advertiseState bool
+	history        *history.Store
+	historyKnown   map[string]bool
+	audit          *audit.Store
+	waterFile      string
+	onEvent        func(Event)
+	lastDeviceTs   time.Time
+	lastMqttCmndTs time.Time
+	pendingOffTs   time.Time
+	deviceOffline  bool
 	StopChan       chan struct{}
 	mqttPub        chan<- mqtt_agent.Msg
 	mqttSub        <-chan mqtt_agent.Msg
 	cmds           chan command
+	stopping       bool
 	state          State
-}
-
-func (m *Manager) msgParseStatePower1(raw string) {
-	m.state.OperStateParsed.DiffuserOn = strings.ToLower(raw) == "on"
+	effect         effectState
+	circadian      []circadianPoint
+	scheduledFile  string
+	scheduled      []ScheduledAction
+	restoreDim     int
+	override       OverridePolicy
+	profile        DeviceProfile
+	palette        Palette
+}
+
+func (m *Manager) setOperDiffuserOn(on bool) {
+	m.checkManualChange(historyDiffuser, m.state.OperStateParsed.DiffuserOn, on)
+	m.recordOnOff(historyDiffuser, m.state.OperStateParsed.DiffuserOn, on)
+	m.state.OperStateParsed.DiffuserOn = on
 	if !m.state.OperStateParsed.DiffuserOn {
 		m.state.OperStateParsed.DiffuserOnSecs = 0
 	}
 }
 
-func (m *Manager) msgParseStatePower2(raw string) {
-	m.state.OperStateParsed.LightOn = strings.ToLower(raw) == "on"
+func (m *Manager) setOperLightOn(on bool) {
+	m.checkManualChange(historyLight, m.state.OperStateParsed.LightOn, on)
+	m.recordOnOff(historyLight, m.state.OperStateParsed.LightOn, on)
+	m.state.OperStateParsed.LightOn = on
 	if !m.state.OperStateParsed.LightOn {
 		m.state.OperStateParsed.LightOnSecs = 0
 	}
 }
 
+func (m *Manager) msgParseStatePower1(raw string) {
+	m.setOperDiffuserOn(strings.ToLower(raw) == "on")
+}
+
+func (m *Manager) msgParseStatePower2(raw string) {
+	m.setOperLightOn(strings.ToLower(raw) == "on")
+}
+
 func (m *Manager) msgParseStateCommon(o *OperState, raw string) {
 	if o.DiffuserOn == "" || o.LightOn == "" || o.LightColor == "" {
 		logger.Errorf("Ignoring unexpected operstate: %+v parse: %s", o, raw)
 		return
 	}
-	m.state.OperStateParsed.DiffuserOn = strings.ToLower(o.DiffuserOn) == "on"
-	if !m.state.OperStateParsed.DiffuserOn {
-		m.state.OperStateParsed.DiffuserOnSecs = 0
-	}
-	m.state.OperStateParsed.LightOn = strings.ToLower(o.LightOn) == "on"
-	if !m.state.OperStateParsed.LightOn {
-		m.state.OperStateParsed.LightOnSecs = 0
-	}
+	m.setOperDiffuserOn(strings.ToLower(o.DiffuserOn) == "on")
+	m.setOperLightOn(strings.ToLower(o.LightOn) == "on")
 	if lightColor, err := parseOperLightColor(o.LightColor); err == nil {
+		if lightColor != m.state.OperStateParsed.LightColor {
+			m.recordHistory(historyLight, "color", fmt.Sprintf("#%06x", lightColor))
+		}
 		m.state.OperStateParsed.LightColor = lightColor
 	}
 	m.state.OperStateParsed.LightDim = o.LightDim
@@ -186,10 +242,10 @@ func (m *Manager) msgParseSmokeyError(payload string) {
 		logger.Errorf("Conversion failed for device payload %v: %s", payload, err)
 		return
 	}
-	if _, found := knownErrorValues[value]; !found {
-		logger.Warnf("Unexpected error value from device: %d (from %q)", value, payload)
-	}
-	newLowWater := value&1 == 1
+	m.updateFaults(value)
+	defer m.checkPendingOff(true)
+	lowWaterBit, found := m.profile.ErrorBits[ErrorLowWater]
+	newLowWater := found && value&(1<<lowWaterBit) != 0
 	if newLowWater == m.state.OperStateParsed.LowWater {
 		// no change
 		return
@@ -198,9 +254,18 @@ func (m *Manager) msgParseSmokeyError(payload string) {
 
 	if newLowWater {
 		logger.Warn("Diffuser is low in water: please refill")
+		if m.state.WantedState.DiffuserOn {
+			m.recordAudit(audit.SourceDevice, onOffAction(historyDiffuser, false), "low water")
+		}
 		m.state.WantedState.DiffuserOn = false
+		m.recordHistory(historyWater, "low", "")
+		m.emitEvent(EventLowWater, nil)
+		m.waterLow()
 	} else {
 		logger.Info("Diffuser has water now: nice")
+		m.recordHistory(historyWater, "refilled", "")
+		m.emitEvent(EventRefilled, nil)
+		m.waterRefilled()
 	}
 }
 
@@ -210,12 +275,23 @@ func (m *Manager) mainLoop() {
 	secondTick := time.Tick(1 * time.Second)
 	checkStatusTickFast := time.Tick(15 * time.Second)
 	checkStatusTickSlow := time.Tick(5 * time.Minute)
+	circadianTick := time.Tick(circadianInterval)
 	var msg mqtt_agent.Msg
 	var cmd command
 	//mgrloop:
 	for {
 		select {
 		case msg = <-m.mqttSub:
+			if msg.Topic == mqtt_agent.TopicConnected {
+				logger.Info("Connected to device: asking for its status")
+				m.cmdPubQueryStatus(nil)
+				continue
+			}
+			if mqtt_agent.IsCmnd(msg.Topic) {
+				m.msgMqttCmnd(msg)
+				continue
+			}
+			m.deviceSeen()
 			switch msg.Topic {
 			case mqtt_agent.TopicSubPower1():
 				m.msgParseStatePower1(msg.Payload)
@@ -227,12 +303,17 @@ func (m *Manager) mainLoop() {
 				m.msgParseStatus11(msg.Payload)
 			case mqtt_agent.TopicSubError():
 				m.msgParseSmokeyError(msg.Payload)
+			case mqtt_agent.TopicSubFanMode():
+				m.msgParseFanMode(msg.Payload)
+			case mqtt_agent.TopicSubResult():
+				m.msgParseResult(msg.Payload)
 			default:
 				//logger.Infof("got topic %s payload %s", msg.Topic, msg.Payload)
-				logger.Infof("got topic %s payload %q...", msg.Topic, mqtt_agent.FirstN(msg.Payload, 10))
+				logger.With("topic", msg.Topic).Infof("got payload %q...", mqtt_agent.FirstN(msg.Payload, 10))
 			}
 		case <-secondTick:
 			m.handleSecondTick()
+			m.runScheduled()
 		case <-checkStatusTickFast:
 			if m.state.OperStateParsed.DiffuserOn ||
 				m.state.OperStateParsed.LightOn ||
@@ -241,10 +322,18 @@ func (m *Manager) mainLoop() {
 				m.cmdPubQueryStatus(nil)
 			}
 			m.bumpSunshineLightDim()
+			m.checkDeviceOffline()
 		case <-checkStatusTickSlow:
 			m.cmdPubQueryStatus(nil)
+			m.saveWaterEstimate()
+		case <-circadianTick:
+			m.checkCircadian()
 		case cmd = <-m.cmds:
 			cmd.run()
+			if m.stopping {
+				logger.Info("manager loop stopped")
+				return
+			}
 		case <-timeout:
 			logger.Trace("manager happy loop")
 			//logger.Info("timing out on manager")
@@ -256,13 +345,16 @@ func (m *Manager) mainLoop() {
 func (m *Manager) bumpSunshineLightDim() {
 	if !m.state.WantedState.LightOn ||
 		!m.state.OperStateParsed.LightOn ||
-		m.state.WantedState.LightMode != Sunshine {
+		m.state.WantedState.LightMode != Sunshine ||
+		m.effect.fadingOut {
 		return
 	}
 
 	if m.state.WantedState.LightDim >= 100 {
 		// Dim reach limit, change mode to crazy
 		logger.Info("Sunshine mode reached max bright. Switching to Crazy mode")
+		m.emitEvent(EventModeFinished, map[string]interface{}{"Mode": Sunshine.String()})
+		m.recordAudit(audit.SourceTimer, "light mode "+Crazy.String(), "sunshine reached max bright")
 		newAutoOffSecs := m.recalculateLightAutoOff()
 		m.cmdLightOn(newAutoOffSecs, Crazy, "")
 	} else {
@@ -283,38 +375,40 @@ func (m *Manager) recalculateLightAutoOff() int {
 }
 
 func (m *Manager) handleSecondTick() {
+	m.reconciled(historyDiffuser, m.state.OperStateParsed.DiffuserOn == m.state.WantedState.DiffuserOn)
+	m.reconciled(historyLight, m.state.OperStateParsed.LightOn == m.state.WantedState.LightOn)
+
 	// Diffuser
+	m.checkPendingOff(false)
 	if m.state.OperStateParsed.DiffuserOn != m.state.WantedState.DiffuserOn &&
-		time.Now().After(m.state.WantedState.DampenDiffuserTs) {
-		logger.Infof("Diffuser not in wanted state: %v", m.state.WantedState.DiffuserOn)
-		m.cmdDiffuser(m.state.WantedState.DiffuserOn)
+		time.Now().After(m.state.WantedState.DampenDiffuserTs) && m.pendingOffTs.IsZero() {
+		if m.shouldReconcile(historyDiffuser) {
+			logger.Infof("Diffuser not in wanted state: %v", m.state.WantedState.DiffuserOn)
+			m.recordAudit(audit.SourceReconcile, onOffAction(historyDiffuser, m.state.WantedState.DiffuserOn),
+				"device was not in wanted state")
+			m.cmdDiffuser(m.state.WantedState.DiffuserOn)
+		}
 	} else {
 		if m.state.OperStateParsed.DiffuserOn {
 			m.state.OperStateParsed.DiffuserOnSecs += 1
+			m.waterDiffuserTick()
 			if m.state.WantedState.DiffuserOn &&
 				m.state.WantedState.DiffuserAutoOffSecs > 0 &&
 				m.state.OperStateParsed.DiffuserOnSecs >= m.state.WantedState.DiffuserAutoOffSecs {
 				logger.Info("Diffuser expiring auto off")
+				m.emitEvent(EventAutoOffExpired, map[string]interface{}{"Component": historyDiffuser})
+				m.recordAudit(audit.SourceTimer, onOffAction(historyDiffuser, false), "auto off expired")
 				m.cmdDiffuserOff()
 			}
 		}
 	}
+	m.checkMist()
 
 	// Light
 	if m.state.OperStateParsed.LightOn != m.state.WantedState.LightOn &&
 		time.Now().After(m.state.WantedState.DampenLightTs) {
-		logger.Infof("Light not in wanted state: %v", m.state.WantedState.LightOn)
-		if m.state.WantedState.LightOn {
-			newAutoOffSecs := m.recalculateLightAutoOff()
-			sameStrColor := LightColor(m.state.WantedState.LightColorName)
-			savedDim := m.state.WantedState.LightDim
-			savedDimOn := m.state.WantedState.LightDimOn
-			m.cmdLightOn(newAutoOffSecs, m.state.WantedState.LightMode, sameStrColor)
-			if savedDimOn {
-				m.cmdLightDim(savedDim)
-			}
-		} else {
-			m.cmdLightOff()
+		if m.shouldReconcile(historyLight) {
+			m.reconcileLight()
 		}
 	} else {
 		if m.state.OperStateParsed.LightOn {
@@ -323,12 +417,35 @@ func (m *Manager) handleSecondTick() {
 				m.state.WantedState.LightAutoOffSecs > 0 &&
 				m.state.OperStateParsed.LightOnSecs >= m.state.WantedState.LightAutoOffSecs {
 				logger.Info("Light expiring auto off")
+				m.emitEvent(EventAutoOffExpired, map[string]interface{}{"Component": historyLight})
+				m.recordAudit(audit.SourceTimer, onOffAction(historyLight, false), "auto off expired")
 				m.cmdLightOff()
+			} else {
+				m.checkFadeOut()
+				m.runLightEffect()
 			}
 		}
 	}
 }
 
+func (m *Manager) reconcileLight() {
+	logger.Infof("Light not in wanted state: %v", m.state.WantedState.LightOn)
+	m.recordAudit(audit.SourceReconcile, onOffAction(historyLight, m.state.WantedState.LightOn),
+		"device was not in wanted state")
+	if m.state.WantedState.LightOn {
+		newAutoOffSecs := m.recalculateLightAutoOff()
+		sameStrColor := LightColor(m.state.WantedState.LightColorName)
+		savedDim := m.state.WantedState.LightDim
+		savedDimOn := m.state.WantedState.LightDimOn
+		m.cmdLightOn(newAutoOffSecs, m.state.WantedState.LightMode, sameStrColor)
+		if savedDimOn {
+			m.cmdLightDim(savedDim)
+		}
+	} else {
+		m.cmdLightOff()
+	}
+}
+
 func (m *Manager) cmdDiffuser(on bool) {
 	var msg mqtt_agent.Msg
 	msg.Topic, msg.Payload = mqtt_agent.MsgPubSetDiffuser(on)
@@ -358,6 +475,7 @@ func (m *Manager) cmdDiffuserOff() {
 }
 
 func (m *Manager) currentState() []byte {
+	m.updateTimers()
 	result, err := json.Marshal(m.state)
 	if err != nil {
 		logger.Errorf("Unable to encode State: %+v: %v", m.state, err)
@@ -367,12 +485,23 @@ func (m *Manager) currentState() []byte {
 	return result
 }
 
-func (m *Manager) currentStateWater() []byte {
-	result := []byte("high")
+func (m *Manager) currentStateWater(asJson bool) []byte {
+	level := "high"
 	if m.state.OperStateParsed.LowWater {
-		result = []byte("low")
+		level = "low"
 	}
 	m.state.Stats.GetStateWaterHits += 1
+	if !asJson {
+		return []byte(level)
+	}
+	result, err := json.Marshal(struct {
+		Level string
+		WaterEstimate
+	}{level, m.state.Water})
+	if err != nil {
+		logger.Errorf("Unable to encode water state: %+v: %v", m.state.Water, err)
+		return nil
+	}
 	return result
 }
 
@@ -382,14 +511,17 @@ func (m *Manager) cmdLight(on bool, mode LightMode, color LightColor) {
 		msg.Topic, msg.Payload = mqtt_agent.MsgPubSetLight(on)
 		m.mqttPub <- msg
 	}
-	modeStr, modeInt := mode.XlateVal()
+	modeStr := mode.String()
+	if on && (mode != m.state.WantedState.LightMode || !m.state.OperStateParsed.LightOn) {
+		m.recordHistory(historyLight, "mode", modeStr)
+	}
 	if on {
-		msg.Topic, msg.Payload = mqtt_agent.MsgPubSetLightMode(modeInt)
+		msg.Topic, msg.Payload = mqtt_agent.MsgPubSetLightMode(m.profile.LightModeCmnd, m.profile.lightModeVal(mode))
 		m.mqttPub <- msg
-		// color only matters in solid and sunshine modes
-		if mode == Solid || mode == Sunshine {
+		if mode.usesColor() {
 			m.cmdLightColor(color)
 		}
+		m.startLightEffect(mode)
 	}
 
 	extraInfo := ""
@@ -403,7 +535,7 @@ func (m *Manager) cmdLight(on bool, mode LightMode, color LightColor) {
 
 	m.state.OperStateParsed.LightOnSecs = 0
 	m.state.WantedState.LightMode = mode
-	m.state.WantedState.LightModeName, _ = mode.XlateVal()
+	m.state.WantedState.LightModeName = modeStr
 	// clear dim on every time mode is set. dim will be used only after being
 	// explicitly set (e.g. mode == Sunshine)
 	m.state.WantedState.LightDimOn = false
@@ -416,13 +548,20 @@ func (m *Manager) cmdLightOn(autoOffSecs int, mode LightMode, color LightColor)
 	m.cmdLight(m.state.WantedState.LightOn, mode, color)
 	if mode == Sunshine {
 		m.cmdLightDim(1)
+	} else if mode == Circadian {
+		m.updateCircadian(0)
+	} else if m.restoreDim > 0 {
+		m.cmdLightDim(m.restoreDim)
 	}
+	m.restoreDim = 0
 }
 
 func (m *Manager) cmdLightColor(color LightColor) {
-	colorInt := color.Int()
+	colorInt := m.colorInt(color)
 	m.state.WantedState.LightColor = colorInt
 	m.state.WantedState.LightColorName = string(color)
+	m.effect.colorTransition = transition{}
+	m.effect.lastRgb = colorInt
 	var msg mqtt_agent.Msg
 	msg.Topic, msg.Payload = mqtt_agent.MsgPubSetLightColor(colorInt)
 	m.mqttPub <- msg
@@ -432,6 +571,8 @@ func (m *Manager) cmdLightColor(color LightColor) {
 func (m *Manager) cmdLightDim(dim int) {
 	m.state.WantedState.LightDim = dim
 	m.state.WantedState.LightDimOn = true
+	m.effect.dimTransition = transition{}
+	m.effect.lastDim = dim
 	var msg mqtt_agent.Msg
 	msg.Topic, msg.Payload = mqtt_agent.MsgPubSetLightDim(dim)
 	m.mqttPub <- msg
@@ -443,26 +584,85 @@ func (m *Manager) cmdLightOff() {
 	m.cmdLight(m.state.WantedState.LightOn, Solid, LightColorOff)
 }
 
+func (m *Manager) applyShutdownPolicy(policy ShutdownPolicy) {
+	logger.Infof("Applying shutdown policy %s", policy)
+	if policy != ShutdownKeep {
+		m.recordAudit(audit.SourceShutdown, "shutdown "+policy.String(), "")
+	}
+	switch policy {
+	case ShutdownAllOff:
+		m.cmdLightOff()
+		m.cmdDiffuserOff()
+	case ShutdownDiffuserOff:
+		m.cmdDiffuserOff()
+	}
+}
+
 func (m *Manager) cmdPubQueryStatus(msg *mqtt_agent.Msg) {
 	if msg == nil {
 		msg = &mqtt_agent.Msg{}
 	}
 	msg.Topic, msg.Payload = mqtt_agent.MsgPubCheckStatus11()
 	m.mqttPub <- *msg
-	msg.Topic, msg.Payload = mqtt_agent.MsgPubCheckWater()
+	msg.Topic, msg.Payload = mqtt_agent.MsgPubCheckWater(m.profile.WaterQueryCmnd)
 	m.mqttPub <- *msg
+	if m.profile.MistCmnd != "" {
+		msg.Topic, msg.Payload = mqtt_agent.MsgPubCheckMist(m.profile.MistCmnd)
+		m.mqttPub <- *msg
+	}
 
 	m.state.Stats.PubQueryStatus += 1
 }
 
-func Start(mqttPub chan<- mqtt_agent.Msg, mqttSub <-chan mqtt_agent.Msg, advertiseState bool) *Manager {
+// Transport carries messages between the manager and the device. They use
+// the mqtt topics of mqtt_agent, whatever the transport is underneath.
+type Transport interface {
+	// Start hands what the device reports to sub and returns the channel
+	// for what is sent to the device
+	Start(sub chan<- mqtt_agent.Msg) chan<- mqtt_agent.Msg
+	// Stop sends what is still queued, giving up after timeout
+	Stop(timeout time.Duration)
+}
+
+func Start(transport Transport, config *Config) *Manager {
+	mqttSub := make(chan mqtt_agent.Msg, 1024)
+	mqttPub := transport.Start(mqttSub)
 	mgr := Manager{
-		advertiseState: advertiseState,
+		advertiseState: config.AdvertiseState,
+		history:        config.History,
+		historyKnown:   make(map[string]bool),
+		audit:          config.Audit,
+		waterFile:      config.WaterFile,
+		scheduledFile:  config.ScheduledFile,
+		override:       config.Override,
+		profile:        config.Profile,
+		palette:        config.Palette,
+		onEvent:        config.OnEvent,
+		lastDeviceTs:   time.Now(),
 		StopChan:       make(chan struct{}),
 		mqttPub:        mqttPub,
 		mqttSub:        mqttSub,
 		cmds:           make(chan command, 1),
 	}
+	mgr.state.Faults.Active = []Fault{}
+	if mgr.profile.Name == "" {
+		mgr.profile = AsakukiProfile
+	}
+	if mgr.palette.entries == nil {
+		mgr.palette.entries = make(map[string]paletteEntry)
+	}
+	mgr.updateWaterEstimate()
+	mgr.loadWaterEstimate()
+	mgr.loadScheduled()
+	curve := config.Circadian
+	if len(curve) == 0 {
+		curve = DefaultCircadianCurve
+	}
+	var err error
+	if mgr.circadian, err = parseCircadianCurve(curve); err != nil {
+		logger.Errorf("Using default circadian curve: %v", err)
+		mgr.circadian, _ = parseCircadianCurve(DefaultCircadianCurve)
+	}
 	go mgr.mainLoop()
 	return &mgr
 }
@@ -481,10 +681,10 @@ func (m *Manager) CurrState() []byte {
 	return *cmd.out
 }
 
-func (m *Manager) CurrStateWater() []byte {
+func (m *Manager) CurrStateWater(asJson bool) []byte {
 	cmd := sCommand{
 		f: func() *[]byte {
-			result := m.currentStateWater()
+			result := m.currentStateWater(asJson)
 			return &result
 		},
 	}
@@ -496,29 +696,60 @@ func (m *Manager) CurrStateWater() []byte {
 }
 
 func (m *Manager) CmdDiffuserOn(autoOffSecs int) {
-	cmd := aCommand{f: func() { m.cmdDiffuserOn(autoOffSecs) }}
+	cmd := aCommand{f: func() {
+		m.resetReconcile(historyDiffuser)
+		m.cmdDiffuserOn(autoOffSecs)
+	}}
 	m.cmds <- &cmd
 }
 
 func (m *Manager) CmdDiffuserOff() {
-	cmd := aCommand{f: func() { m.cmdDiffuserOff() }}
+	cmd := aCommand{f: func() {
+		m.resetReconcile(historyDiffuser)
+		m.cmdDiffuserOff()
+	}}
 	m.cmds <- &cmd
 }
 
-func (m *Manager) CmdLightOn(autoOffSecs int, mode LightMode, color LightColor) {
-	cmd := aCommand{f: func() { m.cmdLightOn(autoOffSecs, mode, color) }}
+func (m *Manager) cmdLightOnEffect(autoOffSecs int, mode LightMode, color LightColor, effect LightEffect) {
+	m.state.WantedState.LightEffect = effect
+	if mode == Cycle && len(effect.Colors) > 0 {
+		color = LightColor(effect.Colors[0])
+	}
+	if color == "" {
+		// no color given: stay with the last one used, if any
+		color = LightColor(m.state.WantedState.LightColorName)
+		if value, err := m.parseColor(color); err != nil || value == 0 {
+			color = LightColorWhite
+		}
+	}
+	m.cmdLightOn(autoOffSecs, mode, color)
+}
+
+func (m *Manager) CmdLightOn(autoOffSecs int, mode LightMode, color LightColor, effect LightEffect) {
+	cmd := aCommand{f: func() {
+		m.resetReconcile(historyLight)
+		m.cmdLightOnEffect(autoOffSecs, mode, color, effect)
+	}}
 	m.cmds <- &cmd
 }
 
-func (m *Manager) CmdLightColor(color LightColor) {
+// CmdLightColor changes the light color, right away or, when transitionSecs
+// is not 0, little by little.
+func (m *Manager) CmdLightColor(color LightColor, transitionSecs int) {
 	cmd := aCommand{f: func() {
-		colorInt := color.Int()
+		// it may turn the light on or off: a fresh set of retries, as
+		// with CmdLightOn and CmdLightOff
+		m.resetReconcile(historyLight)
+		colorInt := m.colorInt(color)
 		if colorInt == 0 {
 			m.cmdLightOff()
 		} else if m.state.WantedState.LightMode != Solid ||
 			!m.state.OperStateParsed.LightOn {
 			autoOffSecs := DefaultAutoOffSeconds
 			m.cmdLightOn(autoOffSecs, Solid, color)
+		} else if transitionSecs > 0 {
+			m.cmdLightColorTransition(color, transitionSecs)
 		} else {
 			m.cmdLightColor(color)
 		}
@@ -526,13 +757,23 @@ func (m *Manager) CmdLightColor(color LightColor) {
 	m.cmds <- &cmd
 }
 
-func (m *Manager) CmdLightDim(dim int) {
-	cmd := aCommand{f: func() { m.cmdLightDim(dim) }}
+func (m *Manager) CmdLightDim(dim int, transitionSecs int) {
+	cmd := aCommand{f: func() {
+		m.resetReconcile(historyLight)
+		if transitionSecs > 0 && m.state.OperStateParsed.LightOn {
+			m.cmdLightDimTransition(dim, transitionSecs)
+		} else {
+			m.cmdLightDim(dim)
+		}
+	}}
 	m.cmds <- &cmd
 }
 
 func (m *Manager) CmdLightOff() {
-	cmd := aCommand{f: func() { m.cmdLightOff() }}
+	cmd := aCommand{f: func() {
+		m.resetReconcile(historyLight)
+		m.cmdLightOff()
+	}}
 	m.cmds <- &cmd
 }
 
@@ -549,3 +790,20 @@ func (m *Manager) CmdQueryStatus() {
 	// wait for sCommand to unlock after getting response
 	cmd.Lock()
 }
+
+// Stop applies the shutdown policy to the device and waits for the manager
+// loop to finish. Messages it published are left in the transport queue.
+func (m *Manager) Stop(policy ShutdownPolicy) {
+	cmd := sCommand{
+		f: func() *[]byte {
+			m.applyShutdownPolicy(policy)
+			m.stopping = true
+			return nil
+		},
+	}
+	cmd.Lock()
+	m.cmds <- &cmd
+	// wait for sCommand to unlock after getting response
+	cmd.Lock()
+	<-m.StopChan
+}
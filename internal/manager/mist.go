@@ -0,0 +1,165 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/audit"
+	"github.com/flavio-fernandes/smokey/internal/mqtt_agent"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MistContinuous   = "continuous"
+	MistIntermittent = "intermittent"
+	MistHigh         = "high"
+	MistLow          = "low"
+)
+
+// mistSetting is the key of the device profile MistLevels for a mode and
+// level, e.g. "continuous-high".
+func mistSetting(mode, level string) string {
+	return mode + "-" + level
+}
+
+func (m *Manager) mistSettings() []string {
+	var settings []string
+	for setting := range m.profile.MistLevels {
+		settings = append(settings, setting)
+	}
+	sort.Strings(settings)
+	return settings
+}
+
+// cmdMist sets the mist mode and level. Empty ones are left as they are,
+// or default to continuous and high.
+func (m *Manager) cmdMist(mode, level string) error {
+	if m.profile.MistCmnd == "" {
+		return fmt.Errorf("device profile %s has no mist control", m.profile.Name)
+	}
+	w := &m.state.WantedState
+	if mode == "" {
+		mode = firstNonEmpty(w.MistMode, m.state.OperStateParsed.MistMode, MistContinuous)
+	}
+	if level == "" {
+		level = firstNonEmpty(w.MistLevel, m.state.OperStateParsed.MistLevel, MistHigh)
+	}
+	mode, level = strings.ToLower(mode), strings.ToLower(level)
+	value, found := m.profile.MistLevels[mistSetting(mode, level)]
+	if !found {
+		return fmt.Errorf("device profile %s has no mist %s. Use one of %v",
+			m.profile.Name, mistSetting(mode, level), m.mistSettings())
+	}
+	if mode != w.MistMode || level != w.MistLevel {
+		m.recordHistory(historyMist, "set", mistSetting(mode, level))
+	}
+	w.MistMode, w.MistLevel = mode, level
+	w.DampenMistTs = time.Now().Add(cmdTsDampenInterval)
+	m.pubMist(value)
+	return nil
+}
+
+func (m *Manager) pubMist(value int) {
+	var msg mqtt_agent.Msg
+	msg.Topic, msg.Payload = mqtt_agent.MsgPubSetMist(m.profile.MistCmnd, value)
+	m.mqttPub <- msg
+	logger.Infof("Asking smokey to set mist to %s %s (%s)",
+		m.state.WantedState.MistMode, m.state.WantedState.MistLevel, msg.Payload)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// msgParseFanMode reads back the mist setting the device reports, as the
+// value of the profile MistLevels.
+func (m *Manager) msgParseFanMode(payload string) {
+	value, err := strconv.Atoi(strings.TrimSpace(payload))
+	if err != nil {
+		logger.Errorf("Conversion failed for fan mode payload %q: %s", payload, err)
+		return
+	}
+	for setting, v := range m.profile.MistLevels {
+		if v != value {
+			continue
+		}
+		parts := strings.SplitN(setting, "-", 2)
+		if len(parts) == 2 {
+			m.state.OperStateParsed.MistMode, m.state.OperStateParsed.MistLevel = parts[0], parts[1]
+			return
+		}
+	}
+	logger.Warnf("Unexpected fan mode value from device: %d", value)
+}
+
+// msgParseResult reads the answer of the device to a command, for the mist
+// value asked for by cmdPubQueryStatus (e.g. {"TuyaEnum1":3}). Answers to
+// other commands are reported on their own topics too, so they are skipped.
+func (m *Manager) msgParseResult(payload string) {
+	if m.profile.MistCmnd == "" {
+		return
+	}
+	var result map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &result); err != nil {
+		logger.Tracef("Ignoring result %q: %v", mqtt_agent.FirstN(payload, 40), err)
+		return
+	}
+	for key, value := range result {
+		if !strings.EqualFold(key, m.profile.MistCmnd) {
+			continue
+		}
+		var mistValue string
+		if json.Unmarshal(value, &mistValue) != nil {
+			mistValue = string(value)
+		}
+		m.msgParseFanMode(mistValue)
+	}
+}
+
+// mistInSync tells whether the device has the wanted mist, or smokey has
+// nothing to compare.
+func (m *Manager) mistInSync() bool {
+	w, o := &m.state.WantedState, &m.state.OperStateParsed
+	return w.MistMode == "" || o.MistMode == "" ||
+		(w.MistMode == o.MistMode && w.MistLevel == o.MistLevel)
+}
+
+// checkMist publishes the wanted mist again when the device reports a
+// different one, e.g. after its button was used or it lost power.
+func (m *Manager) checkMist() {
+	inSync := m.mistInSync()
+	m.reconciled(historyMist, inSync)
+	if inSync || time.Now().Before(m.state.WantedState.DampenMistTs) || !m.shouldReconcile(historyMist) {
+		return
+	}
+	w := &m.state.WantedState
+	logger.Infof("Mist not in wanted state: %s %s", w.MistMode, w.MistLevel)
+	m.recordAudit(audit.SourceReconcile, "mist "+mistSetting(w.MistMode, w.MistLevel),
+		"device was not in wanted state")
+	m.pubMist(m.profile.MistLevels[mistSetting(w.MistMode, w.MistLevel)])
+}
+
+// CmdMist sets the mist mode (continuous or intermittent) and level (high
+// or low) of the diffuser. Empty ones are left as they are.
+func (m *Manager) CmdMist(mode, level string) error {
+	var err error
+	cmd := sCommand{
+		f: func() *[]byte {
+			m.resetReconcile(historyMist)
+			err = m.cmdMist(mode, level)
+			return nil
+		},
+	}
+	cmd.Lock()
+	m.cmds <- &cmd
+	// wait for sCommand to unlock after getting response
+	cmd.Lock()
+	return err
+}
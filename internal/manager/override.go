@@ -0,0 +1,104 @@
+package manager
+
+import (
+	"github.com/flavio-fernandes/smokey/internal/audit"
+	"github.com/flavio-fernandes/smokey/internal/mqtt_agent"
+	"path"
+	"strings"
+	"time"
+)
+
+// msgMqttCmnd is called for a command someone other than smokey published
+// to the device. The change it makes is then seen by checkManualChange.
+func (m *Manager) msgMqttCmnd(msg mqtt_agent.Msg) {
+	action := strings.TrimSpace(path.Base(msg.Topic) + " " + msg.Payload)
+	logger.Infof("mqtt command %q sent to the device outside smokey", action)
+	m.lastMqttCmndTs = time.Now()
+	m.recordAudit(audit.SourceMqtt, action, msg.Topic)
+}
+
+// checkManualChange is called before the device reported state of a
+// component is stored. A change that smokey did not ask for, seen outside of
+// the dampen window that follows its commands, was made on the device itself
+// (e.g. with its button) or by an mqtt command from someone else. With
+// OverrideAdopt it becomes the wanted state, otherwise handleSecondTick
+// reverts it. A diffuser going off is only decided on once the device tells
+// whether it ran out of water.
+func (m *Manager) checkManualChange(component string, wasOn, on bool) {
+	if wasOn == on || !m.historyKnown[component] {
+		return
+	}
+	if component == historyDiffuser {
+		// a newer change replaces the off still waiting for the error value
+		m.pendingOffTs = time.Time{}
+	}
+	wanted, dampenTs := m.state.WantedState.LightOn, m.state.WantedState.DampenLightTs
+	if component == historyDiffuser {
+		wanted, dampenTs = m.state.WantedState.DiffuserOn, m.state.WantedState.DampenDiffuserTs
+	}
+	if on == wanted || time.Now().Before(dampenTs) {
+		return
+	}
+	if component == historyDiffuser && !on {
+		if m.state.OperStateParsed.LowWater {
+			// the device turns the diffuser off by itself when out of water
+			return
+		}
+		// the error value telling the tank is empty may come after the
+		// power report, so ask for it and decide in checkPendingOff
+		m.pendingOffTs = time.Now()
+		msg := mqtt_agent.Msg{}
+		msg.Topic, msg.Payload = mqtt_agent.MsgPubCheckWater(m.profile.WaterQueryCmnd)
+		m.mqttPub <- msg
+		return
+	}
+	m.manualChange(component, on, time.Now())
+}
+
+// checkPendingOff decides whether a diffuser that went off by itself was out
+// of water or turned off on the device. It is called when the device reports
+// its error value and every second, giving up waiting for the error value
+// after lowWaterWaitInterval.
+func (m *Manager) checkPendingOff(errorReported bool) {
+	if m.pendingOffTs.IsZero() {
+		return
+	}
+	if !errorReported && !m.state.OperStateParsed.LowWater &&
+		time.Since(m.pendingOffTs) < lowWaterWaitInterval {
+		return
+	}
+	changeTs := m.pendingOffTs
+	m.pendingOffTs = time.Time{}
+	if m.state.OperStateParsed.LowWater || m.state.OperStateParsed.DiffuserOn {
+		return
+	}
+	m.manualChange(historyDiffuser, false, changeTs)
+}
+
+// manualChange records a change made outside smokey at changeTs and applies
+// the override policy to it.
+func (m *Manager) manualChange(component string, on bool, changeTs time.Time) {
+	event := "off"
+	if on {
+		event = "on"
+	}
+	logger.Infof("%s was turned %s on the device. Override policy is %s", component, event, m.override)
+	m.recordHistory(component, "manual", event)
+	if changeTs.Sub(m.lastMqttCmndTs) > cmdTsDampenInterval {
+		// an mqtt command was already recorded by msgMqttCmnd
+		m.recordAudit(audit.SourceDevice, onOffAction(component, on),
+			"made on the device, override policy "+m.override.String())
+	}
+	m.emitEvent(EventManualChange, map[string]interface{}{
+		"Component": component, "On": on, "Policy": m.override.String()})
+	if m.override != OverrideAdopt {
+		return
+	}
+	if component == historyDiffuser {
+		m.state.WantedState.DiffuserOn = on
+		m.state.WantedState.DiffuserAutoOffSecs = DefaultAutoOffSeconds
+	} else {
+		m.state.WantedState.LightOn = on
+		m.state.WantedState.LightAutoOffSecs = DefaultAutoOffSeconds
+	}
+}
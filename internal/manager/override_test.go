@@ -0,0 +1,83 @@
+package manager
+
+import (
+	"github.com/flavio-fernandes/smokey/internal/mqtt_agent"
+	"testing"
+	"time"
+)
+
+// newOverrideManager has the diffuser on, as wanted, and records the events
+func newOverrideManager(policy OverridePolicy) (*Manager, chan mqtt_agent.Msg, *[]string) {
+	var events []string
+	pub := make(chan mqtt_agent.Msg, 64)
+	m := Manager{
+		historyKnown: map[string]bool{historyDiffuser: true},
+		mqttPub:      pub,
+		override:     policy,
+		profile:      AsakukiProfile,
+		onEvent:      func(e Event) { events = append(events, e.Event) },
+	}
+	m.state.WantedState.DiffuserOn = true
+	m.state.OperStateParsed.DiffuserOn = true
+	return &m, pub, &events
+}
+
+func hasEvent(events []string, event string) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLowWaterOffAfterPowerReport(t *testing.T) {
+	m, _, events := newOverrideManager(OverrideAdopt)
+	m.setOperDiffuserOn(false)
+	m.msgParseSmokeyError("0x01")
+
+	if hasEvent(*events, EventManualChange) {
+		t.Errorf("running out of water was taken as a manual change: %v", *events)
+	}
+	if !hasEvent(*events, EventLowWater) {
+		t.Errorf("expected a low water event: %v", *events)
+	}
+	if m.state.WantedState.DiffuserOn || m.state.WantedState.DiffuserAutoOffSecs != 0 {
+		t.Errorf("unexpected wanted diffuser %+v", m.state.WantedState)
+	}
+}
+
+func TestManualOff(t *testing.T) {
+	// the device tells it has water
+	m, pub, events := newOverrideManager(OverrideAdopt)
+	m.setOperDiffuserOn(false)
+	m.handleSecondTick()
+	if hasEvent(*events, EventManualChange) || len(pub) == 0 {
+		t.Fatalf("expected smokey to ask for the error value first: %v", *events)
+	}
+	m.msgParseSmokeyError("0x00")
+	if !hasEvent(*events, EventManualChange) || m.state.WantedState.DiffuserOn {
+		t.Errorf("expected the manual off to be adopted: %v", *events)
+	}
+
+	// the device does not answer
+	m, _, events = newOverrideManager(OverrideEnforce)
+	m.setOperDiffuserOn(false)
+	m.pendingOffTs = m.pendingOffTs.Add(-lowWaterWaitInterval)
+	m.checkPendingOff(false)
+	if !hasEvent(*events, EventManualChange) || !m.state.WantedState.DiffuserOn {
+		t.Errorf("expected the manual off to be reverted: %v", *events)
+	}
+}
+
+func TestPendingOffHoldsReconcile(t *testing.T) {
+	m, pub, _ := newOverrideManager(OverrideEnforce)
+	m.state.WantedState.DampenDiffuserTs = time.Now().Add(-time.Second)
+	m.setOperDiffuserOn(false)
+	m.handleSecondTick()
+	for len(pub) > 0 {
+		if msg := <-pub; msg.Topic == "cmnd/Power1" && msg.Payload == "ON" {
+			t.Fatalf("diffuser turned back on before knowing about the water: %+v", msg)
+		}
+	}
+}
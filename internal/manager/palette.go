@@ -0,0 +1,290 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	ColorSourceBuiltin = "builtin"
+	ColorSourceCss     = "css"
+	ColorSourceConfig  = "config"
+	ColorSourceUser    = "user"
+)
+
+// NamedColor is a color that can be used by name, e.g. with /lightcolor
+type NamedColor struct {
+	Name   string
+	Rgb    string
+	Source string
+}
+
+type paletteEntry struct {
+	rgb    int
+	source string
+}
+
+// Palette holds the color names defined by the household, either in the
+// config file or through the api. The api ones are saved in file. It is
+// owned by the manager loop, like the rest of its state.
+type Palette struct {
+	file    string
+	entries map[string]paletteEntry
+}
+
+var paletteNameRe = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// ErrPaletteNotSaved is returned when the colors file cannot be written. The
+// change is not made, so the palette stays as it is in the file.
+var ErrPaletteNotSaved = errors.New("unable to save colors")
+
+// parseColor is like LightColor.Parse, also knowing the palette names
+func (m *Manager) parseColor(c LightColor) (int, error) {
+	if entry, found := m.palette.entries[strings.ToLower(strings.TrimSpace(string(c)))]; found {
+		return entry.rgb, nil
+	}
+	return c.Parse()
+}
+
+// colorInt is like parseColor, for colors already known to be good. Bad
+// ones are logged and become white.
+func (m *Manager) colorInt(c LightColor) int {
+	value, err := m.parseColor(c)
+	if err != nil {
+		logger.Errorf("Using white for bad color: %v", err)
+		value, _ = LightColorWhite.Parse()
+	}
+	return value
+}
+
+func checkPaletteName(name string) error {
+	if !paletteNameRe.MatchString(name) {
+		return fmt.Errorf("bad color name %q: use up to 32 lowercase letters, digits, - or _", name)
+	}
+	if _, found := legacyColors[name]; found {
+		return fmt.Errorf("color name %q is builtin", name)
+	}
+	if _, found := cssColors[name]; found {
+		return fmt.Errorf("color name %q is a css color", name)
+	}
+	// since names start with a letter, they never look like hex, rgb(),
+	// temperatures and so on
+	if name == string(LightColorRandom) {
+		return fmt.Errorf("color name %q is reserved", name)
+	}
+	return nil
+}
+
+func parsePaletteValue(name, value string) (int, error) {
+	if strings.ToLower(strings.TrimSpace(value)) == string(LightColorRandom) {
+		return 0, fmt.Errorf("color %s cannot be random", name)
+	}
+	rgb, err := LightColor(value).Parse()
+	if err != nil {
+		return 0, fmt.Errorf("color %s: %v", name, err)
+	}
+	return rgb, nil
+}
+
+// LoadPalette sets up the colors from the config file, followed by the ones
+// previously saved in file through the api.
+func LoadPalette(configColors map[string]string, file string) (Palette, error) {
+	entries := make(map[string]paletteEntry)
+	for name, value := range configColors {
+		name = strings.ToLower(name)
+		if err := checkPaletteName(name); err != nil {
+			return Palette{}, err
+		}
+		rgb, err := parsePaletteValue(name, value)
+		if err != nil {
+			return Palette{}, err
+		}
+		entries[name] = paletteEntry{rgb: rgb, source: ColorSourceConfig}
+	}
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return Palette{}, err
+		}
+		saved := make(map[string]string)
+		if err == nil {
+			if err = json.Unmarshal(data, &saved); err != nil {
+				return Palette{}, fmt.Errorf("bad colors file %s: %v", file, err)
+			}
+		}
+		for name, value := range saved {
+			rgb, err := parsePaletteValue(name, value)
+			if err != nil || checkPaletteName(name) != nil {
+				logger.Warnf("Ignoring saved color %s=%s from %s", name, value, file)
+				continue
+			}
+			if _, found := entries[name]; found {
+				logger.Warnf("Ignoring saved color %s=%s from %s: it is defined in the config file", name, value, file)
+				continue
+			}
+			entries[name] = paletteEntry{rgb: rgb, source: ColorSourceUser}
+		}
+	}
+
+	return Palette{file: file, entries: entries}, nil
+}
+
+func (p *Palette) save() error {
+	if p.file == "" {
+		return nil
+	}
+	saved := make(map[string]string)
+	for name, entry := range p.entries {
+		if entry.source == ColorSourceUser {
+			saved[name] = fmt.Sprintf("#%06x", entry.rgb)
+		}
+	}
+	data, _ := json.MarshalIndent(saved, "", "  ")
+	tmpFile := p.file + ".tmp"
+	err := os.WriteFile(tmpFile, data, 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, p.file)
+	}
+	return err
+}
+
+func (m *Manager) setPaletteColor(name, value string) (NamedColor, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if err := checkPaletteName(name); err != nil {
+		return NamedColor{}, err
+	}
+	rgb, err := parsePaletteValue(name, value)
+	if err != nil {
+		return NamedColor{}, err
+	}
+	p := &m.palette
+	old, found := p.entries[name]
+	if found && old.source == ColorSourceConfig {
+		return NamedColor{}, fmt.Errorf("color %s is defined in the config file", name)
+	}
+	p.entries[name] = paletteEntry{rgb: rgb, source: ColorSourceUser}
+	if err = p.save(); err != nil {
+		if found {
+			p.entries[name] = old
+		} else {
+			delete(p.entries, name)
+		}
+		logger.Errorf("Unable to save colors to %s: %v", p.file, err)
+		return NamedColor{}, fmt.Errorf("%w to %s: %v", ErrPaletteNotSaved, p.file, err)
+	}
+	logger.Infof("Color %s is now #%06x", name, rgb)
+	return NamedColor{Name: name, Rgb: fmt.Sprintf("#%06x", rgb), Source: ColorSourceUser}, nil
+}
+
+func (m *Manager) deletePaletteColor(name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	p := &m.palette
+	entry, found := p.entries[name]
+	if !found {
+		return fmt.Errorf("no user defined color %q", name)
+	}
+	if entry.source == ColorSourceConfig {
+		return fmt.Errorf("color %s is defined in the config file", name)
+	}
+	delete(p.entries, name)
+	if err := p.save(); err != nil {
+		p.entries[name] = entry
+		logger.Errorf("Unable to save colors to %s: %v", p.file, err)
+		return fmt.Errorf("%w to %s: %v", ErrPaletteNotSaved, p.file, err)
+	}
+	logger.Infof("Color %s removed", name)
+	return nil
+}
+
+func (m *Manager) colorNames() []NamedColor {
+	var result []NamedColor
+	add := func(name string, rgb int, source string) {
+		result = append(result, NamedColor{Name: name, Rgb: fmt.Sprintf("#%06x", rgb), Source: source})
+	}
+	for name, rgb := range cssColors {
+		if _, found := legacyColors[name]; !found {
+			add(name, rgb, ColorSourceCss)
+		}
+	}
+	for name, rgb := range legacyColors {
+		add(name, rgb, ColorSourceBuiltin)
+	}
+	for name, entry := range m.palette.entries {
+		add(name, entry.rgb, entry.source)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// SetPaletteColor adds or changes a color name defined through the api.
+func (m *Manager) SetPaletteColor(name, value string) (NamedColor, error) {
+	var namedColor NamedColor
+	var err error
+	cmd := sCommand{
+		f: func() *[]byte {
+			namedColor, err = m.setPaletteColor(name, value)
+			return nil
+		},
+	}
+	cmd.Lock()
+	m.cmds <- &cmd
+	// wait for sCommand to unlock after getting response
+	cmd.Lock()
+	return namedColor, err
+}
+
+// DeletePaletteColor removes a color name defined through the api.
+func (m *Manager) DeletePaletteColor(name string) error {
+	var err error
+	cmd := sCommand{
+		f: func() *[]byte {
+			err = m.deletePaletteColor(name)
+			return nil
+		},
+	}
+	cmd.Lock()
+	m.cmds <- &cmd
+	// wait for sCommand to unlock after getting response
+	cmd.Lock()
+	return err
+}
+
+// ColorNames lists every color that can be used by name, sorted by name.
+func (m *Manager) ColorNames() []NamedColor {
+	var names []NamedColor
+	cmd := sCommand{
+		f: func() *[]byte {
+			names = m.colorNames()
+			return nil
+		},
+	}
+	cmd.Lock()
+	m.cmds <- &cmd
+	// wait for sCommand to unlock after getting response
+	cmd.Lock()
+	return names
+}
+
+// ParseColor converts the color to its rgb value, like LightColor.Parse,
+// also knowing the names in the palette.
+func (m *Manager) ParseColor(c LightColor) (int, error) {
+	var value int
+	var err error
+	cmd := sCommand{
+		f: func() *[]byte {
+			value, err = m.parseColor(c)
+			return nil
+		},
+	}
+	cmd.Lock()
+	m.cmds <- &cmd
+	// wait for sCommand to unlock after getting response
+	cmd.Lock()
+	return value, err
+}
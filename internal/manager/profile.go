@@ -0,0 +1,126 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultProfile = "asakuki"
+	// ErrorLowWater is the name of the error bit that tells the tank is empty
+	ErrorLowWater = "low-water"
+)
+
+// DeviceProfile maps what smokey does to the Tasmota commands of a diffuser
+// model, as they differ in Tuya dpIds and enum values. Commands are sent on
+// cmnd/<command>.
+type DeviceProfile struct {
+	Name string
+	// LightModeCmnd sets the light mode to a value from LightModes
+	LightModeCmnd string
+	// LightModes has the device value for crazy, solid and night-mode. The
+	// other modes are solid, with colors and dim changed by smokey.
+	LightModes map[string]int
+	// WaterQueryCmnd makes the device report its datapoints, including the
+	// error one
+	WaterQueryCmnd string
+	// MistCmnd sets the mist to a value from MistLevels. Both are optional.
+	MistCmnd   string
+	MistLevels map[string]int
+	// ErrorBits names the bits of the error datapoint, e.g. "low-water": 0
+	ErrorBits map[string]int
+}
+
+// AsakukiProfile is the profile used unless another one is picked
+var AsakukiProfile = DeviceProfile{
+	Name:           DefaultProfile,
+	LightModeCmnd:  "TuyaEnum2",
+	LightModes:     map[string]int{"crazy": 0, "solid": 1, "night-mode": 2},
+	WaterQueryCmnd: "TuyaSend8",
+	MistCmnd:       "TuyaEnum1",
+	MistLevels: map[string]int{
+		"continuous-high":   0,
+		"continuous-low":    1,
+		"intermittent-high": 2,
+		"intermittent-low":  3,
+	},
+	// low water is the only error bit known for this model. Others show up
+	// as unknown bits until a profile in the config file names them.
+	ErrorBits: map[string]int{ErrorLowWater: 0},
+}
+
+// deviceMode is the mode the device is set to for a light mode. Modes done
+// by smokey run on top of solid.
+func (m LightMode) deviceMode() LightMode {
+	switch m {
+	case Crazy, NightMode:
+		return m
+	}
+	return Solid
+}
+
+// lightModeVal is the value LightModeCmnd takes for the light mode
+func (p *DeviceProfile) lightModeVal(mode LightMode) int {
+	return p.LightModes[mode.deviceMode().String()]
+}
+
+func (p *DeviceProfile) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("device profile has no name")
+	}
+	if p.LightModeCmnd == "" || p.WaterQueryCmnd == "" {
+		return fmt.Errorf("device profile %s needs LightModeCmnd and WaterQueryCmnd", p.Name)
+	}
+	for _, mode := range []LightMode{Crazy, Solid, NightMode} {
+		if _, found := p.LightModes[mode.String()]; !found {
+			return fmt.Errorf("device profile %s has no value for light mode %s", p.Name, mode)
+		}
+	}
+	if (p.MistCmnd == "") != (len(p.MistLevels) == 0) {
+		return fmt.Errorf("device profile %s needs both MistCmnd and MistLevels, or none", p.Name)
+	}
+	seen := make(map[int]string)
+	for name, bit := range p.ErrorBits {
+		if bit < 0 || bit > 62 {
+			return fmt.Errorf("device profile %s: bad bit %d for error %s. Should be between 0 and 62", p.Name, bit, name)
+		}
+		if other, found := seen[bit]; found {
+			return fmt.Errorf("device profile %s: errors %s and %s use the same bit %d", p.Name, other, name, bit)
+		}
+		seen[bit] = name
+	}
+	return nil
+}
+
+// ValidateProfiles checks the profiles from the config file, so mistakes
+// are caught on start.
+func ValidateProfiles(profiles []DeviceProfile) error {
+	seen := map[string]bool{DefaultProfile: true}
+	for i := range profiles {
+		if err := profiles[i].validate(); err != nil {
+			return err
+		}
+		name := strings.ToLower(profiles[i].Name)
+		if seen[name] {
+			return fmt.Errorf("device profile %s is defined more than once", profiles[i].Name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// FindProfile picks the profile with the given name, from the ones in the
+// config file or the builtin one.
+func FindProfile(name string, profiles []DeviceProfile) (DeviceProfile, error) {
+	if strings.EqualFold(name, DefaultProfile) {
+		return AsakukiProfile, nil
+	}
+	names := []string{DefaultProfile}
+	for _, p := range profiles {
+		if strings.EqualFold(name, p.Name) {
+			return p, nil
+		}
+		names = append(names, p.Name)
+	}
+	return DeviceProfile{}, fmt.Errorf("unknown device profile %q. Known profiles: %v", name, names)
+}
@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"time"
+)
+
+// after this many attempts at getting a component to the wanted state,
+// smokey gives up until the device reports the wanted state again
+const maxReconcileRetries = 6
+
+// Reconcile tells how smokey is doing at getting a component of the device
+// to the wanted state. Retries are spaced exponentially and, once they run
+// out, the component is in Fault until the device reports the wanted state.
+type Reconcile struct {
+	Retries    int
+	Fault      bool
+	FaultSince string `json:",omitempty"`
+	nextTs     time.Time
+}
+
+type ReconcileState struct {
+	Diffuser Reconcile
+	Light    Reconcile
+	Mist     Reconcile
+}
+
+func (m *Manager) reconcileOf(component string) *Reconcile {
+	switch component {
+	case historyDiffuser:
+		return &m.state.Reconcile.Diffuser
+	case historyMist:
+		return &m.state.Reconcile.Mist
+	}
+	return &m.state.Reconcile.Light
+}
+
+// shouldReconcile tells whether it is time to publish the wanted state of
+// the component again. It is called once the dampen window of the last
+// command is over and the device is still not in the wanted state.
+func (m *Manager) shouldReconcile(component string) bool {
+	r := m.reconcileOf(component)
+	now := time.Now()
+	if r.Fault || now.Before(r.nextTs) {
+		return false
+	}
+	if r.Retries >= maxReconcileRetries {
+		r.Fault = true
+		r.FaultSince = ts()
+		logger.Errorf("Giving up on %s after %d retries: device is not doing what it is told", component, r.Retries)
+		m.recordHistory(component, "fault", "")
+		m.emitEvent(EventReconcileFault, map[string]interface{}{"Component": component, "Retries": r.Retries})
+		return false
+	}
+	r.Retries++
+	r.nextTs = now.Add(cmdTsDampenInterval << r.Retries)
+	return true
+}
+
+// reconciled clears the retries and fault of the component once the device
+// is in the wanted state.
+func (m *Manager) reconciled(component string, inSync bool) {
+	r := m.reconcileOf(component)
+	if !inSync || (r.Retries == 0 && !r.Fault) {
+		return
+	}
+	if r.Fault {
+		logger.Infof("%s is in the wanted state again: clearing fault", component)
+		m.recordHistory(component, "fault-cleared", "")
+		m.emitEvent(EventReconcileRecovered, map[string]interface{}{"Component": component})
+	}
+	*r = Reconcile{}
+}
+
+// resetReconcile gives the component a fresh set of retries, for when the
+// wanted state is asked for again.
+func (m *Manager) resetReconcile(component string) {
+	*m.reconcileOf(component) = Reconcile{}
+}
@@ -0,0 +1,176 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/audit"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// MaxScheduleAhead is how far in the future an action can be scheduled
+	MaxScheduleAhead = 7 * 24 * time.Hour
+	// actions that were due while smokey was not running are still done
+	// when it starts, if they are not older than this
+	scheduledGrace = 15 * time.Minute
+)
+
+// ScheduledAction is a diffuser or light on command to be done later.
+// Mode, Color and Effect are only used for the light.
+type ScheduledAction struct {
+	Id          string
+	At          time.Time
+	Component   string
+	AutoOffSecs int
+	Mode        string `json:",omitempty"`
+	Color       string `json:",omitempty"`
+	Effect      LightEffect
+}
+
+func (m *Manager) loadScheduled() {
+	if m.scheduledFile == "" {
+		return
+	}
+	data, err := os.ReadFile(m.scheduledFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("Unable to read scheduled actions %s: %v", m.scheduledFile, err)
+		}
+		return
+	}
+	if err = json.Unmarshal(data, &m.scheduled); err != nil {
+		logger.Errorf("Unable to parse scheduled actions %s: %v", m.scheduledFile, err)
+		return
+	}
+	logger.Infof("Loaded %d scheduled actions", len(m.scheduled))
+}
+
+func (m *Manager) saveScheduled() {
+	if m.scheduledFile == "" {
+		return
+	}
+	data, _ := json.Marshal(m.scheduled)
+	tmpFile := m.scheduledFile + ".tmp"
+	err := os.WriteFile(tmpFile, data, 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, m.scheduledFile)
+	}
+	if err != nil {
+		logger.Errorf("Unable to save scheduled actions %s: %v", m.scheduledFile, err)
+	}
+}
+
+func (m *Manager) schedule(action ScheduledAction) (ScheduledAction, error) {
+	switch action.Component {
+	case TimerDiffuser:
+	case TimerLight:
+		if _, err := LightModeVal(action.Mode); err != nil {
+			return action, fmt.Errorf("bad mode %q: %v", action.Mode, err)
+		}
+	default:
+		return action, fmt.Errorf("unknown component %q. Use %s or %s", action.Component, TimerDiffuser, TimerLight)
+	}
+	if action.At.Before(time.Now()) || time.Until(action.At) > MaxScheduleAhead {
+		return action, fmt.Errorf("time %s should be in the next %v", action.At.Format(time.RFC3339), MaxScheduleAhead)
+	}
+	action.Id = fmt.Sprintf("%08x", rand.Uint32())
+	m.scheduled = append(m.scheduled, action)
+	sort.Slice(m.scheduled, func(i, j int) bool { return m.scheduled[i].At.Before(m.scheduled[j].At) })
+	m.saveScheduled()
+	logger.Infof("Scheduled %s on at %s as %s", action.Component, action.At.Format(time.RFC3339), action.Id)
+	return action, nil
+}
+
+func (m *Manager) cancelScheduled(id string) error {
+	for i, action := range m.scheduled {
+		if action.Id == id {
+			m.scheduled = append(m.scheduled[:i], m.scheduled[i+1:]...)
+			m.saveScheduled()
+			logger.Infof("Cancelled scheduled %s on at %s (%s)", action.Component, action.At.Format(time.RFC3339), id)
+			return nil
+		}
+	}
+	return fmt.Errorf("no scheduled action %q", id)
+}
+
+// runScheduled does the actions that are due. They are kept sorted by
+// time, so it only needs to look at the first ones.
+func (m *Manager) runScheduled() {
+	now := time.Now()
+	ran := 0
+	for _, action := range m.scheduled {
+		if action.At.After(now) {
+			break
+		}
+		ran++
+		if now.Sub(action.At) > scheduledGrace {
+			logger.Warnf("Dropping scheduled %s on %s: it was due at %s",
+				action.Component, action.Id, action.At.Format(time.RFC3339))
+			continue
+		}
+		logger.Infof("Running scheduled %s on %s", action.Component, action.Id)
+		m.recordAudit(audit.SourceSchedule, onOffAction(action.Component, true), "scheduled "+action.Id)
+		m.resetReconcile(action.Component)
+		if action.Component == TimerDiffuser {
+			m.cmdDiffuserOn(action.AutoOffSecs)
+		} else {
+			mode, _ := LightModeVal(action.Mode)
+			m.cmdLightOnEffect(action.AutoOffSecs, mode, LightColor(action.Color), action.Effect)
+		}
+	}
+	if ran > 0 {
+		m.scheduled = m.scheduled[ran:]
+		m.saveScheduled()
+	}
+}
+
+// CmdSchedule adds an action to be done at action.At. The returned copy
+// has the Id that can be used to cancel it.
+func (m *Manager) CmdSchedule(action ScheduledAction) (ScheduledAction, error) {
+	var err error
+	cmd := sCommand{
+		f: func() *[]byte {
+			action, err = m.schedule(action)
+			return nil
+		},
+	}
+	cmd.Lock()
+	m.cmds <- &cmd
+	// wait for sCommand to unlock after getting response
+	cmd.Lock()
+	return action, err
+}
+
+func (m *Manager) CmdCancelScheduled(id string) error {
+	var err error
+	cmd := sCommand{
+		f: func() *[]byte {
+			err = m.cancelScheduled(id)
+			return nil
+		},
+	}
+	cmd.Lock()
+	m.cmds <- &cmd
+	// wait for sCommand to unlock after getting response
+	cmd.Lock()
+	return err
+}
+
+// Scheduled lists the pending actions, soonest first.
+func (m *Manager) Scheduled() []ScheduledAction {
+	result := []ScheduledAction{}
+	cmd := sCommand{
+		f: func() *[]byte {
+			result = append(result, m.scheduled...)
+			return nil
+		},
+	}
+	cmd.Lock()
+	m.cmds <- &cmd
+	// wait for sCommand to unlock after getting response
+	cmd.Lock()
+	return result
+}
@@ -0,0 +1,111 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	TimerDiffuser = "diffuser"
+	TimerLight    = "light"
+)
+
+// Timer is what is left of an auto off. RemainingSecs is -1 and Deadline
+// is empty when the component is off or has no auto off.
+type Timer struct {
+	RemainingSecs int
+	Deadline      string `json:",omitempty"`
+}
+
+type Timers struct {
+	Diffuser Timer
+	Light    Timer
+}
+
+func newTimer(on bool, autoOffSecs, onSecs int) Timer {
+	if !on || autoOffSecs <= 0 {
+		return Timer{RemainingSecs: -1}
+	}
+	remaining := autoOffSecs - onSecs
+	if remaining < 0 {
+		remaining = 0
+	}
+	deadline := time.Now().Add(time.Duration(remaining) * time.Second)
+	return Timer{RemainingSecs: remaining, Deadline: deadline.Format(time.RFC3339)}
+}
+
+func (m *Manager) updateTimers() {
+	m.state.Timers.Diffuser = newTimer(m.state.WantedState.DiffuserOn,
+		m.state.WantedState.DiffuserAutoOffSecs, m.state.OperStateParsed.DiffuserOnSecs)
+	m.state.Timers.Light = newTimer(m.state.WantedState.LightOn,
+		m.state.WantedState.LightAutoOffSecs, m.state.OperStateParsed.LightOnSecs)
+}
+
+// adjustAutoOff moves the auto off of a component that is on, by addSecs
+// (which can be negative) or to deadline, when it is not zero. A component
+// without auto off gets one counting from now.
+func (m *Manager) adjustAutoOff(component string, addSecs int, deadline time.Time) (Timer, error) {
+	var on bool
+	var autoOffSecs *int
+	var onSecs int
+	switch component {
+	case TimerDiffuser:
+		on, autoOffSecs, onSecs = m.state.WantedState.DiffuserOn,
+			&m.state.WantedState.DiffuserAutoOffSecs, m.state.OperStateParsed.DiffuserOnSecs
+	case TimerLight:
+		on, autoOffSecs, onSecs = m.state.WantedState.LightOn,
+			&m.state.WantedState.LightAutoOffSecs, m.state.OperStateParsed.LightOnSecs
+	default:
+		return Timer{}, fmt.Errorf("unknown component %q. Use %s or %s", component, TimerDiffuser, TimerLight)
+	}
+	if !on {
+		return Timer{}, fmt.Errorf("%s is off", component)
+	}
+
+	remaining := *autoOffSecs - onSecs
+	if *autoOffSecs <= 0 {
+		remaining = 0
+	}
+	if !deadline.IsZero() {
+		if !deadline.After(time.Now()) {
+			return Timer{}, fmt.Errorf("deadline %s is in the past", deadline.Format(time.RFC3339))
+		}
+		remaining = int(time.Until(deadline).Round(time.Second).Seconds())
+		// a deadline less than half a second away rounds to 0: keep a
+		// second, so the auto off goes through handleSecondTick
+		if remaining < 1 {
+			remaining = 1
+		}
+	} else {
+		remaining += addSecs
+		if remaining < 1 {
+			return Timer{}, fmt.Errorf("adding %d seconds would leave no time before %s turns off", addSecs, component)
+		}
+	}
+	*autoOffSecs = onSecs + remaining
+	m.updateTimers()
+	timer := m.state.Timers.Diffuser
+	if component == TimerLight {
+		timer = m.state.Timers.Light
+	}
+	logger.Infof("Auto off of %s is now at %s, in %d seconds", component, timer.Deadline, timer.RemainingSecs)
+	return timer, nil
+}
+
+// CmdAdjustAutoOff changes the auto off of the diffuser or light without
+// turning it on again. See adjustAutoOff.
+func (m *Manager) CmdAdjustAutoOff(component string, addSecs int, deadline time.Time) (Timer, error) {
+	var timer Timer
+	var err error
+	cmd := sCommand{
+		f: func() *[]byte {
+			timer, err = m.adjustAutoOff(component, addSecs, deadline)
+			return nil
+		},
+	}
+	cmd.Lock()
+	m.cmds <- &cmd
+	// wait for sCommand to unlock after getting response
+	cmd.Lock()
+	return timer, err
+}
@@ -0,0 +1,110 @@
+package manager
+
+import (
+	"math"
+	"time"
+)
+
+// MaxTransitionSecs is the longest a color or dim transition can take
+const MaxTransitionSecs = 3600
+
+// transition goes from one color or dim to another, one step per second.
+type transition struct {
+	from     int
+	to       int
+	startTs  time.Time
+	duration time.Duration
+}
+
+func (t *transition) active() bool {
+	return t.duration > 0
+}
+
+// ratio tells how far along the transition is, from 0 to 1
+func (t *transition) ratio(now time.Time) float64 {
+	// rounded, since this runs from the second tick
+	elapsed := now.Sub(t.startTs).Round(time.Second)
+	if elapsed >= t.duration {
+		return 1
+	}
+	return float64(elapsed) / float64(t.duration)
+}
+
+func newTransition(from, to, secs int) transition {
+	return transition{from: from, to: to, startTs: time.Now(), duration: time.Duration(secs) * time.Second}
+}
+
+// cmdLightColorTransition changes the light color over transitionSecs,
+// going through colors that look evenly spaced, instead of jumping to it.
+func (m *Manager) cmdLightColorTransition(color LightColor, transitionSecs int) {
+	from := m.state.WantedState.LightColor
+	m.state.WantedState.LightColorName = string(color)
+	m.effect.colorTransition = newTransition(from, m.colorInt(color), transitionSecs)
+	logger.Infof("Changing light color from #%06x to %v (#%06x) in %d seconds",
+		from, color, m.effect.colorTransition.to, transitionSecs)
+}
+
+func (m *Manager) cmdLightDimTransition(dim int, transitionSecs int) {
+	from := m.state.OperStateParsed.LightDim
+	if m.state.WantedState.LightDimOn {
+		from = m.state.WantedState.LightDim
+	}
+	m.effect.dimTransition = newTransition(from, dim, transitionSecs)
+	logger.Infof("Changing light dim from %d to %d in %d seconds", from, dim, transitionSecs)
+}
+
+// stepTransitions publishes the next step of the transitions in progress.
+// It tells whether any was in progress.
+func (m *Manager) stepTransitions(now time.Time) bool {
+	stepped := false
+	if t := &m.effect.colorTransition; t.active() {
+		ratio := t.ratio(now)
+		m.pubEffectColor(mixOklab(t.from, t.to, ratio))
+		if ratio >= 1 {
+			*t = transition{}
+		}
+		stepped = true
+	}
+	if t := &m.effect.dimTransition; t.active() {
+		ratio := t.ratio(now)
+		m.pubEffectDim(t.from + int(math.Round(float64(t.to-t.from)*ratio)))
+		if ratio >= 1 {
+			*t = transition{}
+		}
+		stepped = true
+	}
+	return stepped
+}
+
+// checkFadeOut lowers the dim, step by step, during the last FadeOutSecs
+// before the light auto off, so it does not go dark all at once. The dim
+// goes down to 1, as 0 would turn the light off before smokey does it.
+func (m *Manager) checkFadeOut() {
+	w := &m.state.WantedState
+	if w.LightEffect.FadeOutSecs <= 0 || w.LightAutoOffSecs <= 0 {
+		return
+	}
+	remaining := w.LightAutoOffSecs - m.state.OperStateParsed.LightOnSecs
+	if m.effect.fadingOut {
+		if remaining > w.LightEffect.FadeOutSecs {
+			logger.Infof("Light auto off moved to %d seconds from now: stopping fade out", remaining)
+			m.effect.fadingOut = false
+			m.restoreDim = 0
+			m.cmdLightDim(m.effect.fadeFromDim)
+		}
+		return
+	}
+	if remaining > w.LightEffect.FadeOutSecs {
+		return
+	}
+	from := m.state.OperStateParsed.LightDim
+	if w.LightDimOn {
+		from = w.LightDim
+	}
+	logger.Infof("Light fading out from dim %d in %d seconds", from, remaining)
+	m.effect.fadingOut = true
+	m.effect.fadeFromDim = from
+	m.effect.dimTransition = newTransition(from, 1, remaining)
+	// the device keeps the dim while off: put it back on the next light on
+	m.restoreDim = from
+}
@@ -2,7 +2,6 @@ package manager
 
 import (
 	"fmt"
-	"github.com/antigloss/go/logger"
 	"math"
 	"math/rand"
 	"strconv"
@@ -72,33 +71,103 @@ func ts() string {
 
 type LightColor string
 type LightMode int64
+type ShutdownPolicy int64
+type OverridePolicy int64
 
 const (
 	Crazy LightMode = iota
 	Solid
 	NightMode
 	Sunshine
+	Cycle
+	Candle
+	Breathe
+	Circadian
 
 	LightColorOff = LightColor("off")
 )
 
-func (m LightMode) String() string {
-	s, _ := m.XlateVal()
-	return s
+const (
+	ShutdownKeep ShutdownPolicy = iota
+	ShutdownDiffuserOff
+	ShutdownAllOff
+)
+
+func (p ShutdownPolicy) String() string {
+	switch p {
+	case ShutdownKeep:
+		return "keep"
+	case ShutdownDiffuserOff:
+		return "diffuser-off"
+	case ShutdownAllOff:
+		return "all-off"
+	}
+	return "unknown"
 }
 
-func (m LightMode) XlateVal() (string, int) {
+func ShutdownPolicyVal(p string) (ShutdownPolicy, error) {
+	switch strings.ToLower(p) {
+	case "keep":
+		return ShutdownKeep, nil
+	case "diffuser-off":
+		return ShutdownDiffuserOff, nil
+	case "all-off":
+		return ShutdownAllOff, nil
+	}
+	return ShutdownKeep, fmt.Errorf("No matches found for %s. Use keep, diffuser-off or all-off", p)
+}
+
+const (
+	OverrideEnforce OverridePolicy = iota
+	OverrideAdopt
+)
+
+func (p OverridePolicy) String() string {
+	switch p {
+	case OverrideEnforce:
+		return "enforce"
+	case OverrideAdopt:
+		return "adopt"
+	}
+	return "unknown"
+}
+
+func OverridePolicyVal(p string) (OverridePolicy, error) {
+	switch strings.ToLower(p) {
+	case "enforce":
+		return OverrideEnforce, nil
+	case "adopt":
+		return OverrideAdopt, nil
+	}
+	return OverrideEnforce, fmt.Errorf("No matches found for %s. Use enforce or adopt", p)
+}
+
+func (m LightMode) String() string {
 	switch m {
 	case Crazy:
-		return "crazy", 0
+		return "crazy"
 	case Solid:
-		return "solid", 1
+		return "solid"
 	case NightMode:
-		return "night-mode", 2
+		return "night-mode"
 	case Sunshine:
-		return "sunshine", 1 // same as solid
+		return "sunshine"
+	case Cycle:
+		return "cycle"
+	case Candle:
+		return "candle"
+	case Breathe:
+		return "breathe"
+	case Circadian:
+		return "circadian"
 	}
-	return "unknown", 0
+	return "unknown"
+}
+
+// usesColor tells whether the color given when turning on the light
+// matters in the mode.
+func (m LightMode) usesColor() bool {
+	return m == Solid || m == Sunshine || m == Cycle || m == Breathe
 }
 
 func LightModeVal(l string) (LightMode, error) {
@@ -114,62 +183,14 @@ func LightModeVal(l string) (LightMode, error) {
 		return NightMode, nil
 	case "su":
 		return Sunshine, nil
+	case "cy":
+		return Cycle, nil
+	case "ca":
+		return Candle, nil
+	case "br":
+		return Breathe, nil
+	case "ci":
+		return Circadian, nil
 	}
 	return Crazy, fmt.Errorf("No matches found for %s", l)
 }
-
-func (c LightColor) Int() int {
-	val2 := strings.Split(strings.ToLower(string(c)), "x")
-	valBase := 10
-	if len(val2) > 1 {
-		valBase = 16
-	}
-	val3, err := strconv.ParseInt(val2[len(val2)-1], valBase, 32)
-	// if parsing worked, that is the number we want!
-	if err == nil {
-		return int(val3)
-	}
-	// try converting string to known values
-	// https://www.rapidtables.com/web/color/
-	switch strings.ToLower(string(c)) {
-	case "out":
-		return 0
-	case "none":
-		return 0
-	case "off":
-		return 0
-	case "black":
-		return 0
-	case "red":
-		return 0xff0000
-	case "green":
-		return 0x00ff00
-	case "blue":
-		return 0x0000ff
-	case "yellow":
-		return 0xffff00
-	case "cyan":
-		return 0x00ffff
-	case "magenta":
-		return 0xff00ff
-	case "purple":
-		return 0x4b0082
-	case "pink":
-		return 0xff1493
-	case "orange":
-		return 0xff8c00
-	case "brown":
-		return 0x8b4513
-	case "gold":
-		return 0xd4Af37
-	case "snow":
-		return 0xfffafa
-	case "azure":
-		return 0xf0ffff
-	case "white":
-		return 0xffffff
-	}
-	// catch all: random
-	red, green, blue := rand.Intn(256), rand.Intn(256), rand.Intn(256)
-	return blue + green<<8 + red<<16
-}
@@ -0,0 +1,130 @@
+package manager
+
+import (
+	"encoding/json"
+	"os"
+)
+
+const (
+	// warn when the estimated diffuser run time left is below this
+	waterWarnSecs = 15 * 60
+	// how many tank durations the average gives weight to
+	waterMaxSamples = 10
+)
+
+// WaterEstimate tracks how long the diffuser ran since the tank was last
+// refilled and learns how long a full tank lasts, so it can tell how much
+// run time is left.
+type WaterEstimate struct {
+	RunSecsSinceRefill int
+	RefillSeen         bool
+	AvgTankSecs        int
+	Samples            int
+	Warned             bool
+	RemainingSecs      int
+	PercentFull        int
+}
+
+// waterPersisted is what survives restarts. The rest is derived from it.
+type waterPersisted struct {
+	RunSecsSinceRefill int
+	RefillSeen         bool
+	AvgTankSecs        int
+	Samples            int
+	Warned             bool
+}
+
+func (m *Manager) loadWaterEstimate() {
+	if m.waterFile == "" {
+		return
+	}
+	data, err := os.ReadFile(m.waterFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("Unable to read water estimate %s: %v", m.waterFile, err)
+		}
+		return
+	}
+	var p waterPersisted
+	if err = json.Unmarshal(data, &p); err != nil {
+		logger.Errorf("Unable to parse water estimate %s: %v", m.waterFile, err)
+		return
+	}
+	w := &m.state.Water
+	w.RunSecsSinceRefill, w.RefillSeen, w.AvgTankSecs, w.Samples, w.Warned =
+		p.RunSecsSinceRefill, p.RefillSeen, p.AvgTankSecs, p.Samples, p.Warned
+	logger.Infof("Loaded water estimate: %+v", p)
+	m.updateWaterEstimate()
+}
+
+func (m *Manager) saveWaterEstimate() {
+	if m.waterFile == "" {
+		return
+	}
+	w := &m.state.Water
+	p := waterPersisted{w.RunSecsSinceRefill, w.RefillSeen, w.AvgTankSecs, w.Samples, w.Warned}
+	data, _ := json.Marshal(&p)
+	tmpFile := m.waterFile + ".tmp"
+	err := os.WriteFile(tmpFile, data, 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, m.waterFile)
+	}
+	if err != nil {
+		logger.Errorf("Unable to save water estimate %s: %v", m.waterFile, err)
+	}
+}
+
+func (m *Manager) updateWaterEstimate() {
+	w := &m.state.Water
+	w.RemainingSecs, w.PercentFull = -1, -1
+	if m.state.OperStateParsed.LowWater {
+		w.RemainingSecs, w.PercentFull = 0, 0
+	} else if w.RefillSeen && w.AvgTankSecs > 0 {
+		w.RemainingSecs = w.AvgTankSecs - w.RunSecsSinceRefill
+		if w.RemainingSecs < 0 {
+			// running longer than usual: we just do not know how much is left
+			w.RemainingSecs = 0
+		}
+		w.PercentFull = w.RemainingSecs * 100 / w.AvgTankSecs
+	}
+}
+
+// waterDiffuserTick is called for every second the diffuser is on.
+func (m *Manager) waterDiffuserTick() {
+	w := &m.state.Water
+	w.RunSecsSinceRefill += 1
+	m.updateWaterEstimate()
+	if w.RemainingSecs >= 0 && w.RemainingSecs < waterWarnSecs && !w.Warned {
+		w.Warned = true
+		logger.Warnf("Diffuser is expected to run out of water in about %s",
+			secondsToHuman(w.RemainingSecs))
+		m.recordHistory(historyWater, "warning", "")
+		m.emitEvent(EventWaterWarning, map[string]interface{}{"RemainingSecs": w.RemainingSecs})
+		m.saveWaterEstimate()
+	}
+}
+
+func (m *Manager) waterLow() {
+	w := &m.state.Water
+	if w.RefillSeen && w.RunSecsSinceRefill > 0 {
+		// learn from a tank we saw from full to empty
+		if w.Samples < waterMaxSamples {
+			w.Samples += 1
+		}
+		w.AvgTankSecs += (w.RunSecsSinceRefill - w.AvgTankSecs) / w.Samples
+		logger.Infof("Tank lasted %s. Average is now %s over %d tanks",
+			secondsToHuman(w.RunSecsSinceRefill), secondsToHuman(w.AvgTankSecs), w.Samples)
+	}
+	w.RefillSeen = false
+	m.updateWaterEstimate()
+	m.saveWaterEstimate()
+}
+
+func (m *Manager) waterRefilled() {
+	w := &m.state.Water
+	w.RunSecsSinceRefill = 0
+	w.RefillSeen = true
+	w.Warned = false
+	m.updateWaterEstimate()
+	m.saveWaterEstimate()
+}
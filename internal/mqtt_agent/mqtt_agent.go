@@ -2,11 +2,14 @@ package mqtt_agent
 
 import (
 	"fmt"
-	"github.com/antigloss/go/logger"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/flavio-fernandes/smokey/internal/logging"
+	"strings"
 	"time"
 )
 
+var logger = logging.New("mqtt")
+
 type Msg struct {
 	Topic   string
 	Payload string
@@ -29,23 +32,29 @@ const (
 )
 
 const (
-	DefTopicSubPower1 = "stat/POWER1"
-	DefTopicSubPower2 = "stat/POWER2"
-	//DefTopicSubResult   = "stat/RESULT"
-	DefTopicSubError = "stat/error"
-	//DefTopicSubFanMode  = "stat/fanmode"
+	DefTopicSubPower1   = "stat/POWER1"
+	DefTopicSubPower2   = "stat/POWER2"
+	DefTopicSubResult   = "stat/RESULT"
+	DefTopicSubError    = "stat/error"
+	DefTopicSubFanMode  = "stat/fanmode"
 	DefTopicSubStatus11 = "stat/STATUS11"
 	DefTopicSubState    = "tele/STATE"
+	// commands sent to the device, by smokey or anyone else
+	DefTopicSubCmnd = "cmnd/+"
 
 	DefTopicPubAdvStateLight    = "state/light"
 	DefTopicPubAdvStateDiffuser = "state/diffuser"
 	DefTopicPubCheckStatus      = "cmnd/Status"
-	DefTopicPubCheckWater       = "cmnd/TuyaSend8"
 	DefTopicPubDiffuser         = "cmnd/Power1"
 	DefTopicPubLight            = "cmnd/Power2"
-	DefTopicPubLightMode        = "cmnd/TuyaEnum2"
 	DefTopicPubLightDim         = "cmnd/Dimmer0"
 	DefTopicPubLightColor       = "cmnd/Color1"
+	// for commands that depend on the device profile
+	DefTopicPubCmnd = "cmnd/"
+
+	// TopicConnected is not an mqtt topic: agents hand it to the manager
+	// when they (re)connect to the device, so it can ask for its status
+	TopicConnected = "$smokey/connected"
 )
 
 func TopicSubPower1() string {
@@ -60,6 +69,14 @@ func TopicSubError() string {
 	return gConf.TopicPrefix + DefTopicSubError
 }
 
+func TopicSubFanMode() string {
+	return gConf.TopicPrefix + DefTopicSubFanMode
+}
+
+func TopicSubResult() string {
+	return gConf.TopicPrefix + DefTopicSubResult
+}
+
 func TopicSubStatus11() string {
 	return gConf.TopicPrefix + DefTopicSubStatus11
 }
@@ -68,6 +85,16 @@ func TopicSubState() string {
 	return gConf.TopicPrefix + DefTopicSubState
 }
 
+func TopicSubCmnd() string {
+	return gConf.TopicPrefix + DefTopicSubCmnd
+}
+
+// IsCmnd tells whether the topic is a command sent to the device. The ones
+// smokey sent are not handed to the manager.
+func IsCmnd(topic string) bool {
+	return strings.HasPrefix(topic, gConf.TopicPrefix+DefTopicPubCmnd)
+}
+
 func onStr(on bool) string {
 	if on {
 		return "on"
@@ -87,8 +114,13 @@ func MsgPubCheckStatus11() (string, string) {
 	return gConf.TopicPrefix + DefTopicPubCheckStatus, "11"
 }
 
-func MsgPubCheckWater() (string, string) {
-	return gConf.TopicPrefix + DefTopicPubCheckWater, ""
+func MsgPubCheckWater(cmnd string) (string, string) {
+	return gConf.TopicPrefix + DefTopicPubCmnd + cmnd, ""
+}
+
+// MsgPubCheckMist asks for the mist value, answered on stat/RESULT
+func MsgPubCheckMist(cmnd string) (string, string) {
+	return gConf.TopicPrefix + DefTopicPubCmnd + cmnd, ""
 }
 
 func onOff(on bool) string {
@@ -106,8 +138,12 @@ func MsgPubSetLight(on bool) (string, string) {
 	return gConf.TopicPrefix + DefTopicPubLight, onOff(on)
 }
 
-func MsgPubSetLightMode(mode int) (string, string) {
-	return gConf.TopicPrefix + DefTopicPubLightMode, fmt.Sprintf("%d", mode)
+func MsgPubSetLightMode(cmnd string, mode int) (string, string) {
+	return gConf.TopicPrefix + DefTopicPubCmnd + cmnd, fmt.Sprintf("%d", mode)
+}
+
+func MsgPubSetMist(cmnd string, value int) (string, string) {
+	return gConf.TopicPrefix + DefTopicPubCmnd + cmnd, fmt.Sprintf("%d", value)
 }
 
 func MsgPubSetLightDim(dim int) (string, string) {
@@ -147,6 +183,9 @@ func connectionWorker(connectionQueue <-chan bool) {
 	// Important: the retry mechanism, is based on this defer; which
 	// will basically spawn a new worker as this function is finished
 	defer func() {
+		if isStopping() {
+			return
+		}
 		gClient.Disconnect(500) // 500 Millisecond quiesce
 		time.Sleep(15000 * time.Millisecond)
 		go connectionWorker(connectionQueue) // long lives the worker!
@@ -178,17 +217,19 @@ func connectionWorker(connectionQueue <-chan bool) {
 	for _, topic := range gMqttTopics {
 		token := gClient.Subscribe(topic, 0, nil)
 		if !token.WaitTimeout(20*time.Second) || token.Error() != nil {
-			logger.Warnf("connectionWorker was unable to subscribe to %s: %s",
-				topic, token.Error())
+			logger.With("topic", topic).Warnf("connectionWorker was unable to subscribe: %s", token.Error())
 			return
 		}
-		logger.Trace("connectionWorker subscribed to", topic)
+		logger.With("topic", topic).Trace("connectionWorker subscribed")
 	}
+	gSubChannel <- Msg{Topic: TopicConnected}
 
 	for isConnected {
 		select {
 		case isConnected = <-connectionQueue:
 			logger.Info("connectionWorker got connection callback", isConnected)
+		case <-gStopQueue:
+			return
 		case <-time.After(180 * time.Second):
 			logger.Trace("connectionWorker happy loop")
 		}
@@ -197,39 +238,140 @@ func connectionWorker(connectionQueue <-chan bool) {
 	// if we made it here, defer will reconnect...
 }
 
+// ownEcho tells whether a command seen on the broker is one smokey sent,
+// which comes back since smokey subscribes to the commands of the device.
+// Each command published is matched by one echo, however late it comes.
+// Like rememberSent, it only runs in mqttMessageWorker.
+func ownEcho(msg Msg) bool {
+	for i, sent := range gSentCmnds {
+		if sent == msg {
+			gSentCmnds = append(gSentCmnds[:i], gSentCmnds[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// rememberSent keeps the command until its echo is seen. The oldest are
+// forgotten past maxSentCmnds, for echoes that never come (e.g. when the
+// connection dropped).
+func rememberSent(msg Msg) {
+	if !IsCmnd(msg.Topic) {
+		return
+	}
+	if len(gSentCmnds) >= maxSentCmnds {
+		gSentCmnds = gSentCmnds[1:]
+	}
+	gSentCmnds = append(gSentCmnds, msg)
+}
+
+func publish(msg Msg) {
+	rememberSent(msg)
+	token := gClient.Publish(msg.Topic, 0, false, msg.Payload)
+	if token.WaitTimeout(10 * time.Second) {
+		logger.With("topic", msg.Topic).Tracef("mqttMessageWorker sent %q", msg.Payload)
+		time.Sleep(500 * time.Millisecond)
+	} else {
+		logger.With("topic", msg.Topic).Errorf("mqttMessageWorker timed out sending %q", msg.Payload)
+	}
+}
+
 func mqttMessageWorker(mqttSubMsgChannel chan<- Msg, mqttPubMsgChannel <-chan Msg) {
 	var mqttMsg MQTT.Message
 	var msg Msg
 
+	defer func() { close(gStoppedQueue) }()
 	for {
 		select {
 		case mqttMsg = <-gMessageQueue:
 			msg = Msg{mqttMsg.Topic(), string(mqttMsg.Payload())}
-			logger.Tracef("mqttMessageWorker received %s %q...", msg.Topic, FirstN(msg.Payload, 10))
+			logger.With("topic", msg.Topic).Tracef("mqttMessageWorker received %q...", FirstN(msg.Payload, 10))
+			if IsCmnd(msg.Topic) && ownEcho(msg) {
+				continue
+			}
 			mqttSubMsgChannel <- msg
 		case msg = <-mqttPubMsgChannel:
-			token := gClient.Publish(msg.Topic, 0, false, msg.Payload)
-			if token.WaitTimeout(10 * time.Second) {
-				logger.Tracef("mqttMessageWorker sent %+v", msg)
-				time.Sleep(500 * time.Millisecond)
-			} else {
-				logger.Errorf("mqttMessageWorker timed out sending %+v", msg)
+			publish(msg)
+		case <-gStopQueue:
+			drainPublishQueue(mqttPubMsgChannel)
+			return
+		}
+	}
+}
+
+// drainPublishQueue publishes what is still queued at shutdown. When not
+// connected to the broker, the messages are logged as dropped instead.
+func drainPublishQueue(mqttPubMsgChannel <-chan Msg) {
+	connected := gClient != nil && gClient.IsConnected()
+	logger.Infof("mqttMessageWorker draining %d queued messages. Connected: %t",
+		len(mqttPubMsgChannel), connected)
+	for {
+		select {
+		case msg := <-mqttPubMsgChannel:
+			if !connected {
+				logger.With("topic", msg.Topic).Errorf("mqttMessageWorker not connected, dropping %q", msg.Payload)
+				continue
+			}
+			publish(msg)
+		default:
+			if gClient != nil {
+				gClient.Disconnect(500) // 500 Millisecond quiesce
 			}
+			logger.Info("mqttMessageWorker disconnected")
+			return
 		}
 	}
 }
 
+func isStopping() bool {
+	select {
+	case <-gStopQueue:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop publishes whatever is still queued and disconnects from the broker.
+// It gives up waiting after the provided timeout.
+func Stop(timeout time.Duration) {
+	close(gStopQueue)
+	select {
+	case <-gStoppedQueue:
+	case <-time.After(timeout):
+		logger.Warnf("mqtt agent did not stop within %v", timeout)
+	}
+}
+
+// Transport is the manager.Transport that talks to the device through the
+// mqtt broker.
+type Transport struct {
+	Config Config
+}
+
+func (t *Transport) Start(sub chan<- Msg) chan<- Msg {
+	return Start(&t.Config, sub)
+}
+
+func (t *Transport) Stop(timeout time.Duration) {
+	Stop(timeout)
+}
+
 func Start(config *Config, mqttSubMsgChannel chan<- Msg) chan<- Msg {
-	mqttPubMsgChannel := make(chan Msg, 512)
+	mqttPubMsgChannel := make(chan Msg, pubQueueSize)
 	gConf = *config
+	gSubChannel = mqttSubMsgChannel
 
 	// build subscribe topics, using config's prefix
 	subFuncs := []func() string{
 		TopicSubPower1,
 		TopicSubPower2,
 		TopicSubError,
+		TopicSubFanMode,
+		TopicSubResult,
 		TopicSubStatus11,
 		TopicSubState,
+		TopicSubCmnd,
 	}
 	for _, subFunc := range subFuncs {
 		gMqttTopics = append(gMqttTopics, subFunc())
@@ -259,8 +401,20 @@ var myMqttConnected MQTT.OnConnectHandler = func(client MQTT.Client) {
 
 var gConf Config
 var gClient MQTT.Client
+var gSubChannel chan<- Msg
+
+const (
+	pubQueueSize = 512
+	// no more commands than fit in the queue are waiting for their echo
+	maxSentCmnds = pubQueueSize
+)
+
+// commands smokey published, to tell them apart from the ones sent by others
+var gSentCmnds []Msg
 var gMessageQueue = make(chan MQTT.Message, 1024)
 var gConnectionQueue = make(chan bool)
+var gStopQueue = make(chan struct{})
+var gStoppedQueue = make(chan struct{})
 var gMqttTopics = []string{
 	// Note: Additional sub topics will be appended here upon Start
 }
@@ -0,0 +1,97 @@
+package web
+
+import (
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/audit"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type auditResponse struct {
+	From    time.Time
+	To      time.Time
+	Entries []audit.Entry
+}
+
+// statusWriter remembers the status of the response, so only the commands
+// that worked are audited.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// changesState tells whether the request is a command for the device, as
+// opposed to reading the state or asking the device to report it.
+func changesState(r *http.Request) bool {
+	method := strings.ToLower(r.Method)
+	return method != "get" && r.URL.Path != "/query" && r.URL.Path != "/inform"
+}
+
+// recordAudit records who sent the command: the client address and the name
+// of the api token. The form values are kept as details.
+func recordAudit(r *http.Request, requestId string) {
+	if gConf.Audit == nil {
+		return
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	token, _ := requestTokenName(r)
+	entry := audit.Entry{
+		Source:  audit.SourceApi,
+		Client:  client,
+		Token:   token,
+		Request: requestId,
+		Action:  r.Method + " " + r.URL.Path,
+	}
+	if err := r.ParseForm(); err == nil {
+		entry.Details = auditForm(r.Form).Encode()
+	}
+	gConf.Audit.Record(entry)
+}
+
+// auditForm drops what looks like a credential from the form values, so it
+// does not end up on disk
+func auditForm(form url.Values) url.Values {
+	kept := url.Values{}
+	for key, values := range form {
+		lower := strings.ToLower(key)
+		secret := false
+		for _, word := range []string{"token", "pass", "secret", "auth", "key"} {
+			secret = secret || strings.Contains(lower, word)
+		}
+		if !secret {
+			kept[key] = values
+		}
+	}
+	return kept
+}
+
+func auditGet(w http.ResponseWriter, r *http.Request) {
+	if gConf.Audit == nil {
+		http.Error(w, "audit is not enabled", http.StatusNotFound)
+		return
+	}
+	var err error
+	if err = r.ParseForm(); err != nil {
+		badRequest(w, r, fmt.Sprintf("bad form for audit: %v", err))
+		return
+	}
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		badRequest(w, r, fmt.Sprintf("bad time range for audit: %v", err))
+		return
+	}
+	source := strings.ToLower(r.FormValue("source"))
+	response := auditResponse{From: from, To: to, Entries: gConf.Audit.Query(from, to, source)}
+	writeJson(w, http.StatusOK, &response)
+}
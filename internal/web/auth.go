@@ -0,0 +1,82 @@
+package web
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiToken is a bearer token allowed to send commands. The name is only used
+// to tell clients apart (e.g. "alexa", "ctl") and is never sent over the wire.
+type apiToken struct {
+	name  string
+	token string
+}
+
+var gTokens []apiToken
+
+// loadTokens reads a file where each line has a token name followed by the
+// token itself. Empty lines and lines starting with # are ignored.
+func loadTokens(tokenFile string) ([]apiToken, error) {
+	f, err := os.Open(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []apiToken
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <name> <token>", tokenFile, lineNum)
+		}
+		tokens = append(tokens, apiToken{name: fields[0], token: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens found in %s", tokenFile)
+	}
+	return tokens, nil
+}
+
+// requestTokenName returns the name of the token used by the request, if
+// the request carries a known bearer token.
+func requestTokenName(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(auth) <= len(prefix) || strings.ToLower(auth[:len(prefix)]) != prefix {
+		return "", false
+	}
+	given := []byte(strings.TrimSpace(auth[len(prefix):]))
+	for _, t := range gTokens {
+		if subtle.ConstantTimeCompare(given, []byte(t.token)) == 1 {
+			return t.name, true
+		}
+	}
+	return "", false
+}
+
+func tokenVerified(r *http.Request) bool {
+	if len(gTokens) == 0 {
+		return true
+	}
+	_, found := requestTokenName(r)
+	return found
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	errorStr := fmt.Sprintf("valid api token required for %s %s", r.Method, r.RequestURI)
+	requestLogger(r).Error(errorStr)
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, errorStr, http.StatusUnauthorized)
+}
@@ -0,0 +1,64 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/manager"
+	"net/http"
+)
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Errorf("Failed sending response: %v", err)
+	}
+}
+
+// colorsError is for a palette that could not be saved, which is not the
+// fault of the request.
+func colorsError(w http.ResponseWriter, r *http.Request, errorStr string) {
+	requestLogger(r).Error(errorStr)
+	http.Error(w, errorStr, http.StatusInternalServerError)
+}
+
+func colorsGet(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, http.StatusOK, mgr.ColorNames())
+}
+
+func colorsSet(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if err = r.ParseForm(); err != nil {
+		badRequest(w, r, fmt.Sprintf("bad form for colors: %v", err))
+		return
+	}
+	namedColor, err := mgr.SetPaletteColor(r.FormValue("name"), r.FormValue("color"))
+	if errors.Is(err, manager.ErrPaletteNotSaved) {
+		colorsError(w, r, fmt.Sprintf("cannot set color: %v", err))
+		return
+	}
+	if err != nil {
+		badRequest(w, r, fmt.Sprintf("bad color for colors: %v", err))
+		return
+	}
+	writeJson(w, http.StatusOK, &namedColor)
+}
+
+func colorsDelete(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if err = r.ParseForm(); err != nil {
+		badRequest(w, r, fmt.Sprintf("bad form for colors: %v", err))
+		return
+	}
+	err = mgr.DeletePaletteColor(r.FormValue("name"))
+	if errors.Is(err, manager.ErrPaletteNotSaved) {
+		colorsError(w, r, fmt.Sprintf("cannot delete color: %v", err))
+		return
+	}
+	if err != nil {
+		badRequest(w, r, fmt.Sprintf("unable to delete color: %v", err))
+		return
+	}
+	noContent(w)
+}
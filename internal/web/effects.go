@@ -0,0 +1,99 @@
+package web
+
+import (
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/manager"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// splitColors splits a comma separated list of colors, leaving the commas
+// inside rgb(), hsl() and friends alone.
+func splitColors(s string) []string {
+	var result []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',', ';':
+			if depth == 0 {
+				result = append(result, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		result = append(result, last)
+	}
+	return result
+}
+
+func parseIntParam(r *http.Request, name string, def, min, max int) (int, error) {
+	valueStr := r.FormValue(name)
+	if valueStr == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseInt(valueStr, 10, 32)
+	if err != nil {
+		return def, fmt.Errorf("bad %s: %v", name, err)
+	}
+	if int(v) < min || int(v) > max {
+		return def, fmt.Errorf("bad %s: %s. Should be between %d and %d", name, valueStr, min, max)
+	}
+	return int(v), nil
+}
+
+// parseLightEffect gets the parameters of the modes driven by smokey and
+// the fade out
+func parseLightEffect(r *http.Request, mode manager.LightMode) (manager.LightEffect, error) {
+	var effect manager.LightEffect
+	var err error
+	if effect.FadeOutSecs, err = parseIntParam(r, "fadeOutSecs", 0, 0, manager.MaxTransitionSecs); err != nil {
+		return effect, err
+	}
+	switch mode {
+	case manager.Cycle:
+		effect.Colors = splitColors(r.FormValue("colors"))
+		if len(effect.Colors) < 2 {
+			return effect, fmt.Errorf("cycle needs at least 2 comma separated colors")
+		}
+		for _, color := range effect.Colors {
+			if _, err = mgr.ParseColor(manager.LightColor(color)); err != nil {
+				return effect, err
+			}
+		}
+		effect.IntervalSecs, err = parseIntParam(r, "intervalSecs", manager.DefaultCycleIntervalSecs, 1, 3600)
+		if err != nil {
+			return effect, err
+		}
+		if crossfade := r.FormValue("crossfade"); crossfade != "" {
+			if effect.Crossfade, err = strconv.ParseBool(crossfade); err != nil {
+				return effect, fmt.Errorf("bad crossfade: %v", err)
+			}
+		}
+	case manager.Breathe:
+		if effect.MinDim, err = parseIntParam(r, "minDim", manager.DefaultBreatheMinDim, 1, 100); err != nil {
+			return effect, err
+		}
+		if effect.MaxDim, err = parseIntParam(r, "maxDim", manager.DefaultBreatheMaxDim, 1, 100); err != nil {
+			return effect, err
+		}
+		if effect.MinDim >= effect.MaxDim {
+			return effect, fmt.Errorf("minDim %d should be below maxDim %d", effect.MinDim, effect.MaxDim)
+		}
+		effect.Bpm = manager.DefaultBreatheBpm
+		if bpmStr := r.FormValue("bpm"); bpmStr != "" {
+			if effect.Bpm, err = strconv.ParseFloat(bpmStr, 64); err != nil {
+				return effect, fmt.Errorf("bad bpm: %v", err)
+			}
+			if effect.Bpm < 1 || effect.Bpm > manager.MaxBreatheBpm {
+				return effect, fmt.Errorf("bad bpm: %s. Should be between 1 and %v", bpmStr, manager.MaxBreatheBpm)
+			}
+		}
+	}
+	return effect, nil
+}
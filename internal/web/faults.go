@@ -0,0 +1,36 @@
+package web
+
+import (
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/history"
+	"github.com/flavio-fernandes/smokey/internal/manager"
+	"net/http"
+	"time"
+)
+
+type faultsResponse struct {
+	manager.DeviceFaults
+	From   time.Time
+	To     time.Time
+	Events []history.Event
+}
+
+// faultsGet shows the faults the device reports now and when faults were
+// set or cleared, from the history.
+func faultsGet(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if err = r.ParseForm(); err != nil {
+		badRequest(w, r, fmt.Sprintf("bad form for faults: %v", err))
+		return
+	}
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		badRequest(w, r, fmt.Sprintf("bad time range for faults: %v", err))
+		return
+	}
+	response := faultsResponse{DeviceFaults: mgr.Faults(), From: from, To: to, Events: []history.Event{}}
+	if gConf.History != nil {
+		response.Events = append(response.Events, gConf.History.Query(from, to, "fault")...)
+	}
+	writeJson(w, http.StatusOK, &response)
+}
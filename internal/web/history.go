@@ -0,0 +1,95 @@
+package web
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type historyResponse struct {
+	From   time.Time
+	To     time.Time
+	Events interface{}
+	OnSecs map[string]int
+}
+
+func parseTimeParam(r *http.Request, name string, def time.Time) (time.Time, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseTimeRange gets from and to params as RFC3339 timestamps. From
+// defaults to 7 days ago and to defaults to now.
+func parseTimeRange(r *http.Request) (time.Time, time.Time, error) {
+	now := time.Now()
+	from, err := parseTimeParam(r, "from", now.Add(-7*24*time.Hour))
+	if err != nil {
+		return from, now, fmt.Errorf("bad from: %v", err)
+	}
+	to, err := parseTimeParam(r, "to", now)
+	if err != nil {
+		return from, to, fmt.Errorf("bad to: %v", err)
+	}
+	if to.Before(from) {
+		return from, to, fmt.Errorf("to %v is before from %v", to, from)
+	}
+	return from, to, nil
+}
+
+func historyGet(w http.ResponseWriter, r *http.Request) {
+	if gConf.History == nil {
+		http.Error(w, "history is not enabled", http.StatusNotFound)
+		return
+	}
+	var err error
+	if err = r.ParseForm(); err != nil {
+		badRequest(w, r, fmt.Sprintf("bad form for history: %v", err))
+		return
+	}
+	from, to, err := parseTimeRange(r)
+	if err != nil {
+		badRequest(w, r, fmt.Sprintf("bad time range for history: %v", err))
+		return
+	}
+	component := strings.ToLower(r.FormValue("component"))
+	events := gConf.History.Query(from, to, component)
+
+	switch strings.ToLower(r.FormValue("format")) {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=smokey_history.csv")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"ts", "component", "event", "value"})
+		for _, e := range events {
+			cw.Write([]string{e.Ts.Format(time.RFC3339), e.Component, e.Event, e.Value})
+		}
+		cw.Flush()
+		if err = cw.Error(); err != nil {
+			requestLogger(r).Errorf("Failed sending history csv: %v", err)
+		}
+	case "", "json":
+		response := historyResponse{
+			From:   from,
+			To:     to,
+			Events: events,
+			OnSecs: map[string]int{},
+		}
+		for _, c := range []string{"diffuser", "light"} {
+			if component == "" || component == c {
+				response.OnSecs[c] = gConf.History.OnSecs(from, to, c)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(&response); err != nil {
+			requestLogger(r).Errorf("Failed sending history response: %v", err)
+		}
+	default:
+		badRequest(w, r, fmt.Sprintf("bad format for history: %s. Use json or csv", r.FormValue("format")))
+	}
+}
@@ -0,0 +1,40 @@
+package web
+
+import (
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/manager"
+	"net/http"
+	"strings"
+)
+
+// mist sets the mist mode (continuous or intermittent) and level (high or
+// low) of the diffuser. Either can be left out to keep it as it is.
+func mist(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		badRequest(w, r, fmt.Sprintf("bad form for mist: %v", err))
+		return
+	}
+	mode := strings.ToLower(r.FormValue("mode"))
+	level := strings.ToLower(r.FormValue("level"))
+	if mode == "" && level == "" {
+		badRequest(w, r, "mist needs mode or level")
+		return
+	}
+	if mode != "" && mode != manager.MistContinuous && mode != manager.MistIntermittent {
+		badRequest(w, r, fmt.Sprintf("bad mode for mist: %q. Use %s or %s",
+			mode, manager.MistContinuous, manager.MistIntermittent))
+		return
+	}
+	if level != "" && level != manager.MistHigh && level != manager.MistLow {
+		badRequest(w, r, fmt.Sprintf("bad level for mist: %q. Use %s or %s",
+			level, manager.MistHigh, manager.MistLow))
+		return
+	}
+	if err := mgr.CmdMist(mode, level); err != nil {
+		errorStr := fmt.Sprintf("cannot set mist: %v", err)
+		requestLogger(r).Error(errorStr)
+		http.Error(w, errorStr, http.StatusConflict)
+		return
+	}
+	noContent(w)
+}
@@ -0,0 +1,64 @@
+package web
+
+import (
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/manager"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// parseStartTime gets when an on command should happen, from delaySecs or
+// at (RFC3339). It is zero when the command is for right now.
+func parseStartTime(r *http.Request) (time.Time, error) {
+	delaySecsStr := r.FormValue("delaySecs")
+	atStr := r.FormValue("at")
+	switch {
+	case delaySecsStr != "" && atStr != "":
+		return time.Time{}, fmt.Errorf("use either delaySecs or at")
+	case delaySecsStr != "":
+		delaySecs, err := strconv.ParseInt(delaySecsStr, 10, 32)
+		if err != nil || delaySecs < 0 {
+			return time.Time{}, fmt.Errorf("bad delaySecs: %s", delaySecsStr)
+		}
+		if delaySecs == 0 {
+			return time.Time{}, nil
+		}
+		return time.Now().Add(time.Duration(delaySecs) * time.Second).Round(time.Second), nil
+	case atStr != "":
+		at, err := time.Parse(time.RFC3339, atStr)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad at: %v", err)
+		}
+		return at, nil
+	}
+	return time.Time{}, nil
+}
+
+func scheduleAction(w http.ResponseWriter, r *http.Request, action manager.ScheduledAction) {
+	action, err := mgr.CmdSchedule(action)
+	if err != nil {
+		badRequest(w, r, fmt.Sprintf("cannot schedule %s: %v", action.Component, err))
+		return
+	}
+	writeJson(w, http.StatusAccepted, &action)
+}
+
+func scheduledGet(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, http.StatusOK, mgr.Scheduled())
+}
+
+func scheduledDelete(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if err = r.ParseForm(); err != nil {
+		badRequest(w, r, fmt.Sprintf("bad form for scheduled: %v", err))
+		return
+	}
+	if err = mgr.CmdCancelScheduled(r.FormValue("id")); err != nil {
+		errorStr := fmt.Sprintf("cannot cancel: %v", err)
+		requestLogger(r).Error(errorStr)
+		http.Error(w, errorStr, http.StatusNotFound)
+		return
+	}
+	noContent(w)
+}
@@ -0,0 +1,50 @@
+package web
+
+import (
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/manager"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// timerAdjust moves the auto off of the light or diffuser, either by
+// addSecs (negative to shorten it) or to an absolute deadline.
+func timerAdjust(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if err = r.ParseForm(); err != nil {
+		badRequest(w, r, fmt.Sprintf("bad form for timer: %v", err))
+		return
+	}
+	component := r.FormValue("component")
+	if component != manager.TimerDiffuser && component != manager.TimerLight {
+		badRequest(w, r, fmt.Sprintf("bad component for timer: %q. Use %s or %s",
+			component, manager.TimerDiffuser, manager.TimerLight))
+		return
+	}
+	addSecsStr := r.FormValue("addSecs")
+	deadlineStr := r.FormValue("deadline")
+	if (addSecsStr == "") == (deadlineStr == "") {
+		badRequest(w, r, "timer needs either addSecs or deadline")
+		return
+	}
+	var addSecs int64
+	var deadline time.Time
+	if addSecsStr != "" {
+		if addSecs, err = strconv.ParseInt(addSecsStr, 10, 32); err != nil {
+			badRequest(w, r, fmt.Sprintf("bad addSecs for timer: %v", err))
+			return
+		}
+	} else if deadline, err = time.Parse(time.RFC3339, deadlineStr); err != nil {
+		badRequest(w, r, fmt.Sprintf("bad deadline for timer: %v", err))
+		return
+	}
+	timer, err := mgr.CmdAdjustAutoOff(component, int(addSecs), deadline)
+	if err != nil {
+		errorStr := fmt.Sprintf("cannot change timer: %v", err)
+		requestLogger(r).Error(errorStr)
+		http.Error(w, errorStr, http.StatusConflict)
+		return
+	}
+	writeJson(w, http.StatusOK, &timer)
+}
@@ -0,0 +1,111 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader hands out the server certificate, loading it again from
+// disk whenever the cert or key files are modified (e.g. renewed by certbot).
+type certReloader struct {
+	sync.Mutex
+	certFile    string
+	keyFile     string
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.maybeReload(); err != nil {
+		return nil, err
+	}
+	return &cr, nil
+}
+
+func (cr *certReloader) maybeReload() error {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil &&
+		certInfo.ModTime().Equal(cr.certModTime) &&
+		keyInfo.ModTime().Equal(cr.keyModTime) {
+		// no change
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil {
+		logger.Infof("Reloaded tls certificate from %s", cr.certFile)
+	}
+	cr.cert = &cert
+	cr.certModTime = certInfo.ModTime()
+	cr.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+func (cr *certReloader) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.Lock()
+	defer cr.Unlock()
+	if err := cr.maybeReload(); err != nil {
+		// keep serving the last good certificate while files are being replaced
+		logger.Errorf("Unable to reload tls certificate %s: %v", cr.certFile, err)
+	}
+	return cr.cert, nil
+}
+
+func newTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both cert and key files are needed for tls")
+	}
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+	}
+	if clientCAFile != "" {
+		caPem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in client ca file %s", clientCAFile)
+		}
+		tlsConfig.ClientCAs = caPool
+		// Anyone may look at the state, but only verified clients are allowed
+		// to send commands. That is enforced by clientCertVerified.
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return &tlsConfig, nil
+}
+
+func clientCertVerified(r *http.Request) bool {
+	if gConf.TLSClientCAFile == "" {
+		return true
+	}
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	errorStr := fmt.Sprintf("client certificate required for %s %s", r.Method, r.RequestURI)
+	requestLogger(r).Error(errorStr)
+	http.Error(w, errorStr, http.StatusForbidden)
+}
@@ -0,0 +1,16 @@
+package web
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed ui/index.html
+var uiIndex []byte
+
+func dashboard(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write(uiIndex); err != nil {
+		logger.Errorf("Failed sending dashboard: %v", err)
+	}
+}
@@ -1,16 +1,35 @@
 package web
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/antigloss/go/logger"
+	"github.com/flavio-fernandes/smokey/internal/audit"
+	"github.com/flavio-fernandes/smokey/internal/history"
+	"github.com/flavio-fernandes/smokey/internal/logging"
 	"github.com/flavio-fernandes/smokey/internal/manager"
+	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 )
 
+var logger = logging.New("web")
+
 var mgr *manager.Manager
+var gConf Config
+var gServer *http.Server
+
+type Config struct {
+	ListenPort      string
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	TokenFile       string
+	History         *history.Store
+	Audit           *audit.Store
+}
 
 var (
 	epoch          = time.Unix(0, 0).Format(time.RFC1123)
@@ -30,15 +49,50 @@ var (
 	}
 )
 
-func Start(manager *manager.Manager, listenPort string) {
+func Start(manager *manager.Manager, config *Config) {
 	mgr = manager
-	go webWorker(listenPort)
+	gConf = *config
+	if gConf.TokenFile != "" {
+		var err error
+		if gTokens, err = loadTokens(gConf.TokenFile); err != nil {
+			logger.Fatalf("Unable to load api tokens: %v", err)
+		}
+		logger.Infof("Loaded %d api tokens from %s", len(gTokens), gConf.TokenFile)
+	}
+	http.HandleFunc("/", index)
+	gServer = &http.Server{Addr: ":" + gConf.ListenPort}
+	go webWorker()
 }
 
-func webWorker(listenPort string) {
-	http.HandleFunc("/", index)
-	logger.Infof("Starting web server on port %s", listenPort)
-	logger.Fatal(http.ListenAndServe(":"+listenPort, nil))
+// Stop closes the listener and waits for in flight requests to finish,
+// until ctx is done.
+func Stop(ctx context.Context) {
+	if err := gServer.Shutdown(ctx); err != nil {
+		logger.Errorf("Web server shutdown: %v", err)
+		return
+	}
+	logger.Info("Web server stopped")
+}
+
+func webWorker() {
+	var err error
+	if gConf.TLSCertFile == "" && gConf.TLSKeyFile == "" {
+		logger.Infof("Starting web server on port %s", gConf.ListenPort)
+		err = gServer.ListenAndServe()
+	} else {
+		tlsConfig, tlsErr := newTLSConfig(gConf.TLSCertFile, gConf.TLSKeyFile, gConf.TLSClientCAFile)
+		if tlsErr != nil {
+			logger.Fatalf("Unable to setup tls for web server: %v", tlsErr)
+		}
+		gServer.TLSConfig = tlsConfig
+		logger.Infof("Starting https web server on port %s (client certs: %v)",
+			gConf.ListenPort, gConf.TLSClientCAFile != "")
+		// cert and key are provided by tlsConfig.GetCertificate
+		err = gServer.ListenAndServeTLS("", "")
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatal(err)
+	}
 }
 
 func noCache(w http.ResponseWriter, r *http.Request) {
@@ -74,22 +128,27 @@ func managerQueryStatus(w http.ResponseWriter, r *http.Request) {
 	managerState(w, r)
 }
 
-func managerStateWater(w http.ResponseWriter, _ *http.Request) {
-	response := mgr.CurrStateWater()
+func managerStateWater(w http.ResponseWriter, r *http.Request) {
+	asJson := strings.ToLower(r.URL.Query().Get("format")) == "json"
+	response := mgr.CurrStateWater(asJson)
 	if response == nil {
 		errorStr := "Unable to get state water from manager"
-		logger.Error(errorStr)
+		requestLogger(r).Error(errorStr)
 		http.Error(w, errorStr, http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "text/plain; charset=us-ascii")
+	if asJson {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=us-ascii")
+	}
 	if _, err := w.Write(response); err != nil {
-		logger.Errorf("Failed sending state water response: %v", err)
+		requestLogger(r).Errorf("Failed sending state water response: %v", err)
 	}
 }
 
-func badRequest(w http.ResponseWriter, errorStr string) {
-	logger.Error(errorStr)
+func badRequest(w http.ResponseWriter, r *http.Request, errorStr string) {
+	requestLogger(r).Error(errorStr)
 	http.Error(w, errorStr, http.StatusBadRequest)
 }
 
@@ -101,7 +160,7 @@ func noContent(w http.ResponseWriter) {
 func lighton(w http.ResponseWriter, r *http.Request) {
 	var err error
 	if err = r.ParseForm(); err != nil {
-		badRequest(w, fmt.Sprintf("bad form for lighton: %v", err))
+		badRequest(w, r, fmt.Sprintf("bad form for lighton: %v", err))
 		return
 	}
 	autoOffSecsStr := r.FormValue("autoOffSecs")
@@ -112,7 +171,7 @@ func lighton(w http.ResponseWriter, r *http.Request) {
 	if autoOffSecsStr != "" {
 		v, err := strconv.ParseInt(autoOffSecsStr, 10, 32)
 		if err != nil {
-			badRequest(w, fmt.Sprintf("bad autoOffSecs for lighton: %v", err))
+			badRequest(w, r, fmt.Sprintf("bad autoOffSecs for lighton: %v", err))
 			return
 		}
 		autoOffSecs = int(v)
@@ -121,11 +180,32 @@ func lighton(w http.ResponseWriter, r *http.Request) {
 	if modeStr != "" {
 		mode, err = manager.LightModeVal(modeStr)
 		if err != nil {
-			badRequest(w, fmt.Sprintf("bad mode for lighton: %v", err))
+			badRequest(w, r, fmt.Sprintf("bad mode for lighton: %v", err))
+			return
+		}
+	}
+	if colorStr != "" {
+		if _, err = mgr.ParseColor(manager.LightColor(colorStr)); err != nil {
+			badRequest(w, r, fmt.Sprintf("bad color for lighton: %v", err))
 			return
 		}
 	}
-	mgr.CmdLightOn(autoOffSecs, mode, manager.LightColor(colorStr))
+	effect, err := parseLightEffect(r, mode)
+	if err != nil {
+		badRequest(w, r, fmt.Sprintf("bad %s mode for lighton: %v", mode, err))
+		return
+	}
+	at, err := parseStartTime(r)
+	if err != nil {
+		badRequest(w, r, fmt.Sprintf("bad start for lighton: %v", err))
+		return
+	}
+	if !at.IsZero() {
+		scheduleAction(w, r, manager.ScheduledAction{At: at, Component: manager.TimerLight,
+			AutoOffSecs: autoOffSecs, Mode: mode.String(), Color: colorStr, Effect: effect})
+		return
+	}
+	mgr.CmdLightOn(autoOffSecs, mode, manager.LightColor(colorStr), effect)
 	noContent(w)
 }
 
@@ -137,38 +217,52 @@ func lightoff(w http.ResponseWriter, _ *http.Request) {
 func lightcolor(w http.ResponseWriter, r *http.Request) {
 	var err error
 	if err = r.ParseForm(); err != nil {
-		badRequest(w, fmt.Sprintf("bad form for lightcolor: %v", err))
+		badRequest(w, r, fmt.Sprintf("bad form for lightcolor: %v", err))
 		return
 	}
 	colorStr := r.FormValue("color")
-	mgr.CmdLightColor(manager.LightColor(colorStr))
+	if _, err = mgr.ParseColor(manager.LightColor(colorStr)); err != nil {
+		badRequest(w, r, fmt.Sprintf("bad color for lightcolor: %v", err))
+		return
+	}
+	transitionSecs, err := parseIntParam(r, "transition", 0, 0, manager.MaxTransitionSecs)
+	if err != nil {
+		badRequest(w, r, fmt.Sprintf("bad lightcolor: %v", err))
+		return
+	}
+	mgr.CmdLightColor(manager.LightColor(colorStr), transitionSecs)
 	noContent(w)
 }
 
 func lightdim(w http.ResponseWriter, r *http.Request) {
 	var err error
 	if err = r.ParseForm(); err != nil {
-		badRequest(w, fmt.Sprintf("bad form for lightdim: %v", err))
+		badRequest(w, r, fmt.Sprintf("bad form for lightdim: %v", err))
 		return
 	}
 	dimStr := r.FormValue("dim")
 	dim, err := strconv.ParseInt(dimStr, 10, 32)
 	if err != nil {
-		badRequest(w, fmt.Sprintf("bad value for lightdim %s: %v", dimStr, err))
+		badRequest(w, r, fmt.Sprintf("bad value for lightdim %s: %v", dimStr, err))
 		return
 	}
 	if dim < 0 || dim > 100 {
-		badRequest(w, fmt.Sprintf("bad dim: %s. Should be between 0 and 100", dimStr))
+		badRequest(w, r, fmt.Sprintf("bad dim: %s. Should be between 0 and 100", dimStr))
+		return
+	}
+	transitionSecs, err := parseIntParam(r, "transition", 0, 0, manager.MaxTransitionSecs)
+	if err != nil {
+		badRequest(w, r, fmt.Sprintf("bad lightdim: %v", err))
 		return
 	}
-	mgr.CmdLightDim(int(dim))
+	mgr.CmdLightDim(int(dim), transitionSecs)
 	noContent(w)
 }
 
 func diffuseron(w http.ResponseWriter, r *http.Request) {
 	var err error
 	if err = r.ParseForm(); err != nil {
-		badRequest(w, fmt.Sprintf("bad form for diffuseron: %v", err))
+		badRequest(w, r, fmt.Sprintf("bad form for diffuseron: %v", err))
 		return
 	}
 	autoOffSecsStr := r.FormValue("autoOffSecs")
@@ -176,11 +270,21 @@ func diffuseron(w http.ResponseWriter, r *http.Request) {
 	if autoOffSecsStr != "" {
 		v, err := strconv.ParseInt(autoOffSecsStr, 10, 32)
 		if err != nil {
-			badRequest(w, fmt.Sprintf("bad autoOffSecs for diffuseron: %v", err))
+			badRequest(w, r, fmt.Sprintf("bad autoOffSecs for diffuseron: %v", err))
 			return
 		}
 		autoOffSecs = int(v)
 	}
+	at, err := parseStartTime(r)
+	if err != nil {
+		badRequest(w, r, fmt.Sprintf("bad start for diffuseron: %v", err))
+		return
+	}
+	if !at.IsZero() {
+		scheduleAction(w, r, manager.ScheduledAction{At: at, Component: manager.TimerDiffuser,
+			AutoOffSecs: autoOffSecs})
+		return
+	}
 	mgr.CmdDiffuserOn(autoOffSecs)
 	noContent(w)
 }
@@ -192,11 +296,18 @@ func diffuseroff(w http.ResponseWriter, _ *http.Request) {
 
 var (
 	getters = map[string]func(http.ResponseWriter, *http.Request){
-		"/":       managerState,
-		"/state":  managerState,
-		"/status": managerState,
-		"/query":  managerQueryStatus,
-		"/water":  managerStateWater,
+		"/":          managerState,
+		"/state":     managerState,
+		"/status":    managerState,
+		"/query":     managerQueryStatus,
+		"/water":     managerStateWater,
+		"/ui":        dashboard,
+		"/ui/":       dashboard,
+		"/history":   historyGet,
+		"/colors":    colorsGet,
+		"/scheduled": scheduledGet,
+		"/faults":    faultsGet,
+		"/audit":     auditGet,
 	}
 	posters = map[string]func(http.ResponseWriter, *http.Request){
 		"/inform":      http.NotFound,
@@ -209,28 +320,66 @@ var (
 		"/smokeoff":    diffuseroff,
 		"/diffuseron":  diffuseron,
 		"/diffuseroff": diffuseroff,
+		"/colors":      colorsSet,
+		"/timer":       timerAdjust,
+		"/mist":        mist,
+	}
+	// privateGetters need the same client cert and token as commands, since
+	// they show who uses smokey
+	privateGetters = map[string]bool{
+		"/audit": true,
 	}
 	deleters = map[string]func(http.ResponseWriter, *http.Request){
 		"/lighton":    lightoff,
 		"/smokeon":    diffuseroff,
 		"/diffuseron": diffuseroff,
+		"/colors":     colorsDelete,
+		"/scheduled":  scheduledDelete,
 	}
 )
 
+type requestLoggerKey struct{}
+
+// requestLogger tags logs with the request id and command of the request
+func requestLogger(r *http.Request) *logging.Logger {
+	if reqLogger, ok := r.Context().Value(requestLoggerKey{}).(*logging.Logger); ok {
+		return reqLogger
+	}
+	return logger
+}
+
 func index(w http.ResponseWriter, r *http.Request) {
 	noCache(w, r)
 	var haveHandler bool
 	var handler func(http.ResponseWriter, *http.Request)
 	if strings.ToLower(r.Method) == "get" {
-		handler, haveHandler = getters[r.RequestURI]
+		handler, haveHandler = getters[r.URL.Path]
 	} else if strings.ToLower(r.Method) == "post" {
-		handler, haveHandler = posters[r.RequestURI]
+		handler, haveHandler = posters[r.URL.Path]
 	} else if strings.ToLower(r.Method) == "delete" {
-		handler, haveHandler = deleters[r.RequestURI]
+		handler, haveHandler = deleters[r.URL.Path]
 	}
 	if !haveHandler {
 		handler = http.NotFound
+	} else if strings.ToLower(r.Method) != "get" || privateGetters[r.URL.Path] {
+		if !clientCertVerified(r) {
+			handler = forbidden
+		} else if !tokenVerified(r) {
+			handler = unauthorized
+		}
+	}
+	requestId := fmt.Sprintf("%08x", rand.Uint32())
+	w.Header().Set("X-Request-Id", requestId)
+	reqLogger := logger.With("request", requestId).With("command", r.Method+" "+r.URL.Path)
+	r = r.WithContext(context.WithValue(r.Context(), requestLoggerKey{}, reqLogger))
+	reqLogger.Infof("serving %s %s for %s: hit %v", r.Method, r.RequestURI, r.RemoteAddr, haveHandler)
+	if !haveHandler || !changesState(r) {
+		handler(w, r)
+		return
+	}
+	sw := statusWriter{ResponseWriter: w, status: http.StatusOK}
+	handler(&sw, r)
+	if sw.status < http.StatusBadRequest {
+		recordAudit(r, requestId)
 	}
-	logger.Infof("serving %s %s: hit %v", r.Method, r.RequestURI, haveHandler)
-	handler(w, r)
 }
@@ -0,0 +1,262 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/flavio-fernandes/smokey/internal/logging"
+	"github.com/flavio-fernandes/smokey/internal/manager"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var logger = logging.New("webhook")
+
+// Hook is a url that gets a POST with the event as json body. When Secret
+// is set, the body is signed with HMAC-SHA256 and the hex digest is sent
+// in the X-Smokey-Signature header as "sha256=<digest>". An empty Events
+// list subscribes to all events.
+type Hook struct {
+	Url        string
+	Secret     string
+	Events     []string
+	MaxRetries int
+}
+
+const (
+	DefMaxRetries  = 5
+	queueSize      = 64
+	httpTimeout    = 10 * time.Second
+	initialBackoff = 2 * time.Second
+	maxBackoff     = 5 * time.Minute
+)
+
+// delivery is an event that failed and waits for its next attempt
+type delivery struct {
+	body    []byte
+	attempt int
+	backoff time.Duration
+	nextTs  time.Time
+}
+
+type hookWorker struct {
+	hook    Hook
+	events  map[string]struct{}
+	queue   chan []byte
+	pending []*delivery
+}
+
+type Dispatcher struct {
+	workers    []*hookWorker
+	httpClient *http.Client
+	stop       chan struct{}
+	// ctx is cancelled when Stop gives up on the pending deliveries
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Validate checks the hooks before they are used, so typos in the event
+// names are caught on start.
+func Validate(hooks []Hook) error {
+	known := make(map[string]struct{})
+	for _, e := range manager.EventNames {
+		known[e] = struct{}{}
+	}
+	for i, h := range hooks {
+		if h.Url == "" {
+			return fmt.Errorf("webhook %d has no url", i)
+		}
+		for _, e := range h.Events {
+			if _, found := known[e]; !found {
+				return fmt.Errorf("webhook %s: unknown event %q. Known events: %v", h.Url, e, manager.EventNames)
+			}
+		}
+	}
+	return nil
+}
+
+func Start(hooks []Hook) *Dispatcher {
+	d := Dispatcher{httpClient: &http.Client{Timeout: httpTimeout}, stop: make(chan struct{})}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, h := range hooks {
+		if h.MaxRetries <= 0 {
+			h.MaxRetries = DefMaxRetries
+		}
+		w := hookWorker{hook: h, queue: make(chan []byte, queueSize)}
+		if len(h.Events) > 0 {
+			w.events = make(map[string]struct{})
+			for _, e := range h.Events {
+				w.events[e] = struct{}{}
+			}
+		}
+		d.workers = append(d.workers, &w)
+		d.wg.Add(1)
+		go d.worker(&w)
+	}
+	logger.Infof("Started %d webhooks", len(d.workers))
+	return &d
+}
+
+// Notify queues the event to every hook subscribed to it. It never blocks,
+// so it is safe to call from the manager loop.
+func (d *Dispatcher) Notify(event manager.Event) {
+	body, err := json.Marshal(&event)
+	if err != nil {
+		logger.Errorf("Unable to encode event %+v: %v", event, err)
+		return
+	}
+	for _, w := range d.workers {
+		if w.events != nil {
+			if _, subscribed := w.events[event.Event]; !subscribed {
+				continue
+			}
+		}
+		select {
+		case w.queue <- body:
+		default:
+			logger.Errorf("Webhook %s queue is full: dropping event %s", w.hook.Url, event.Event)
+		}
+	}
+}
+
+// Stop delivers what is still queued, once and without retries, giving up
+// after timeout. Events that could not be delivered are dropped.
+func (d *Dispatcher) Stop(timeout time.Duration) {
+	close(d.stop)
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		// abort the deliveries in flight; workers drop what is left
+		d.cancel()
+		<-done
+	}
+	d.cancel()
+	logger.Info("Webhooks stopped")
+}
+
+// worker delivers the events of a hook. Failed deliveries wait for their
+// retry in w.pending, so a dead endpoint does not hold back newer events.
+func (d *Dispatcher) worker(w *hookWorker) {
+	defer d.wg.Done()
+	retryTimer := time.NewTimer(time.Hour)
+	retryTimer.Stop()
+	for {
+		select {
+		case body := <-w.queue:
+			d.attempt(w, &delivery{body: body, backoff: initialBackoff})
+		case <-retryTimer.C:
+			now := time.Now()
+			due := w.pending
+			w.pending = nil
+			for _, dl := range due {
+				if dl.nextTs.After(now) {
+					w.pending = append(w.pending, dl)
+					continue
+				}
+				d.attempt(w, dl)
+			}
+		case <-d.stop:
+			retryTimer.Stop()
+			d.flush(w)
+			return
+		}
+		if len(w.pending) > 0 {
+			next := w.pending[0].nextTs
+			for _, dl := range w.pending[1:] {
+				if dl.nextTs.Before(next) {
+					next = dl.nextTs
+				}
+			}
+			if !retryTimer.Stop() {
+				select {
+				case <-retryTimer.C:
+				default:
+				}
+			}
+			retryTimer.Reset(time.Until(next))
+		}
+	}
+}
+
+// attempt delivers dl, queuing it for a retry with backoff if that fails
+func (d *Dispatcher) attempt(w *hookWorker, dl *delivery) {
+	retry, err := d.deliver(&w.hook, dl.body)
+	if err == nil {
+		logger.Tracef("Webhook %s delivered %s", w.hook.Url, dl.body)
+		return
+	}
+	if !retry || dl.attempt >= w.hook.MaxRetries {
+		logger.Errorf("Webhook %s giving up on %s: %v", w.hook.Url, dl.body, err)
+		return
+	}
+	logger.Warnf("Webhook %s failed (attempt %d), retrying in %v: %v",
+		w.hook.Url, dl.attempt+1, dl.backoff, err)
+	dl.attempt++
+	dl.nextTs = time.Now().Add(dl.backoff)
+	dl.backoff *= 2
+	if dl.backoff > maxBackoff {
+		dl.backoff = maxBackoff
+	}
+	w.pending = append(w.pending, dl)
+}
+
+// flush tries what is pending and queued once more, for when smokey stops
+func (d *Dispatcher) flush(w *hookWorker) {
+	bodies := make([][]byte, 0, len(w.pending)+len(w.queue))
+	for _, dl := range w.pending {
+		bodies = append(bodies, dl.body)
+	}
+	w.pending = nil
+	for len(w.queue) > 0 {
+		bodies = append(bodies, <-w.queue)
+	}
+	for i, body := range bodies {
+		if d.ctx.Err() != nil {
+			logger.Warnf("Webhook %s stopping: dropping %d undelivered events", w.hook.Url, len(bodies)-i)
+			return
+		}
+		if _, err := d.deliver(&w.hook, body); err != nil {
+			logger.Errorf("Webhook %s stopping: dropping %s: %v", w.hook.Url, body, err)
+		}
+	}
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts the body once. It tells whether a failure is worth retrying.
+func (d *Dispatcher) deliver(hook *Hook, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "smokey-webhook")
+	if hook.Secret != "" {
+		req.Header.Set("X-Smokey-Signature", sign(hook.Secret, body))
+	}
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("got %s", resp.Status)
+}